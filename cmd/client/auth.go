@@ -0,0 +1,195 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// signatureHeader carries the HMAC signature of requests to the proxy.
+const signatureHeader = "X-PushProx-Signature"
+
+// ProxyAuthenticator authenticates the requests sent to the proxy.
+type ProxyAuthenticator interface {
+	// Apply adds the credentials to the request.
+	Apply(*http.Request) error
+}
+
+// noAuth sends requests without credentials.
+type noAuth struct{}
+
+func (noAuth) Apply(*http.Request) error { return nil }
+
+// basicAuth authenticates with a username and password.
+type basicAuth struct {
+	username, password string
+}
+
+func (a basicAuth) Apply(r *http.Request) error {
+	r.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+// bearerAuth authenticates with a bearer token.
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) Apply(r *http.Request) error {
+	r.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// hmacAuth signs requests with a shared secret. The signature is the
+// HMAC-SHA256 of the timestamp, method, path and SHA256 of the body, each
+// followed by a newline, and is sent as "t=<unix timestamp>,sig=<hex>".
+type hmacAuth struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func (a hmacAuth) Apply(r *http.Request) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return errors.Wrap(err, "reading request body to sign")
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	ts := strconv.FormatInt(a.now().Unix(), 10)
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x\n", ts, r.Method, r.URL.EscapedPath(), bodySum)
+	r.Header.Set(signatureHeader, fmt.Sprintf("t=%s,sig=%s", ts, hex.EncodeToString(mac.Sum(nil))))
+	return nil
+}
+
+// newProxyAuthenticator returns the authenticator for authType, reading
+// the password, token or secret from credentialsFile.
+func newProxyAuthenticator(authType, username, credentialsFile string) (ProxyAuthenticator, error) {
+	if authType == "" || authType == "none" {
+		return noAuth{}, nil
+	}
+	if credentialsFile == "" {
+		return nil, fmt.Errorf("--proxy.auth.credentials-file is required for %s authentication", authType)
+	}
+	content, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading proxy credentials")
+	}
+	credentials := strings.TrimSpace(string(content))
+	if credentials == "" {
+		return nil, fmt.Errorf("no credentials in %s", credentialsFile)
+	}
+	switch authType {
+	case "basic":
+		return basicAuth{username: username, password: credentials}, nil
+	case "bearer":
+		return bearerAuth{token: credentials}, nil
+	case "hmac":
+		return hmacAuth{secret: []byte(credentials), now: time.Now}, nil
+	}
+	return nil, fmt.Errorf("unknown proxy authentication type %q", authType)
+}
+
+// tokenFile is a token read from a file, which is re-read once ttl has
+// passed so that rotated tokens are picked up without a restart. If the
+// file can't be re-read, the previous token is used until the next attempt.
+type tokenFile struct {
+	file string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	readAt time.Time
+}
+
+// get returns the current token.
+func (f *tokenFile) get() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if f.token != "" && now.Sub(f.readAt) < f.ttl {
+		return f.token, nil
+	}
+	content, err := ioutil.ReadFile(f.file)
+	token := strings.TrimSpace(string(content))
+	if err == nil && token == "" {
+		err = fmt.Errorf("no token in %s", f.file)
+	}
+	if err != nil {
+		if f.token != "" {
+			f.readAt = now
+			return f.token, nil
+		}
+		return "", errors.Wrap(err, "reading bearer token")
+	}
+	f.token, f.readAt = token, now
+	return f.token, nil
+}
+
+// commandToken is a token printed by a command, which is run again once ttl
+// has passed. The command is run without a shell and with the environment
+// of the client.
+type commandToken struct {
+	command string
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	token string
+	ranAt time.Time
+}
+
+// get returns the current token, running the command with ctx if needed.
+func (t *commandToken) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if t.token != "" && now.Sub(t.ranAt) < t.ttl {
+		return t.token, nil
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.command)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		preScrapeCommandFailuresCounter.Inc()
+		return "", errors.Wrapf(err, "running pre-scrape command %s: %s", t.command, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		preScrapeCommandFailuresCounter.Inc()
+		return "", fmt.Errorf("pre-scrape command %s printed nothing", t.command)
+	}
+	t.token, t.ranAt = token, now
+	return t.token, nil
+}
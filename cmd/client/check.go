@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// checkConfig runs the startup checks of the flags and --config.file that
+// need no network, for the check-config command, and returns every problem
+// found. The FQDN isn't looked up, and --startup.require-target isn't
+// dialed.
+func checkConfig(logger log.Logger) []error {
+	var errs []error
+	check := func(err error, what string) {
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, what))
+		}
+	}
+
+	check(expandPathFlags(logger), "invalid file path")
+	switch {
+	case *proxyURLFile != "" && *proxyURL != "":
+		errs = append(errs, errors.New("--proxy-url and --proxy-url-file are mutually exclusive"))
+	case *proxyURLFile != "":
+		_, err := readProxyURLFile(*proxyURLFile)
+		check(err, "invalid --proxy-url-file")
+	case *proxyURL == "":
+		errs = append(errs, errors.New("--proxy-url or --proxy-url-file flag must be specified"))
+	default:
+		if u, err := url.Parse(*proxyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid --proxy-url %q", *proxyURL))
+		}
+	}
+	for _, p := range []string{*pollPath, *pushPath} {
+		check(validateEndpointPath(p), "invalid proxy endpoint path")
+	}
+	_, err := loadConfig(*configFile)
+	check(err, "invalid configuration")
+	if *scrapeURLRewrite != "" {
+		_, err := parseURLRewrite(*scrapeURLRewrite)
+		check(err, "invalid --scrape.url-rewrite")
+	}
+	for _, port := range *localScrapeAllowedPorts {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("invalid --local-scrape.allowed-ports %q", port))
+		}
+	}
+	if *scrapeAddFQDNLabel != "" {
+		check(validateLabelName(*scrapeAddFQDNLabel), "invalid --scrape.add-fqdn-label")
+	}
+	_, err = newBodyTransformers(logger, scrapeTransformerNames())
+	check(err, "invalid --scrape.transform")
+	if *scrapeBearerTokenFile != "" {
+		_, err := (&tokenFile{file: *scrapeBearerTokenFile, now: time.Now}).get()
+		check(err, "failed to read --scrape.bearer-token-file")
+	}
+	_, err = parseStaticHeaders(*proxyHeaderFlags)
+	check(err, "invalid --proxy.header")
+	_, err = parseStaticHeaders(*pushHeaderFlags)
+	check(err, "invalid --push.header")
+	_, err = newProxyAuthenticator(*proxyAuthType, *proxyAuthUsername, *proxyAuthCredentialsFile)
+	check(err, "invalid proxy authentication")
+	_, err = loadTLSConfig()
+	check(err, "failed to load TLS configuration")
+	if *proxySignRegistration && *tlsCert == "" {
+		errs = append(errs, errors.New("--proxy.sign-registration requires --tls.cert and --tls.key"))
+	}
+	if *proxyBindAddress != "" {
+		_, err := parseBindAddress(*proxyBindAddress)
+		check(err, "invalid --proxy.bind-address")
+	}
+	if *scrapeBindAddress != "" {
+		_, err := parseBindAddress(*scrapeBindAddress)
+		check(err, "invalid --scrape.bind-address")
+	}
+	if *scrapeDialBudgetFraction < 0 || *scrapeDialBudgetFraction > 1 {
+		errs = append(errs, errors.New("--scrape.dial-budget-fraction must be between 0 and 1"))
+	}
+	if conflicts := selfScrapeTargets(*metricsAddr, mappedScrapeTargets()); len(conflicts) > 0 && *selfMetricsPath == "" {
+		err := fmt.Errorf("scrape targets %s are mapped onto the client's own metrics listener", strings.Join(conflicts, ","))
+		if *strictConfig {
+			errs = append(errs, err)
+		} else {
+			level.Warn(logger).Log("msg", "Scrapes will fail", "err", err)
+		}
+	}
+	_, err = parseCertPins(*proxyTLSPins)
+	check(err, "invalid --proxy.tls.pin")
+	return errs
+}
+
+// runCheckConfig reports the problems found by checkConfig and returns the
+// exit code of the check-config command.
+func runCheckConfig(logger log.Logger) int {
+	errs := checkConfig(logger)
+	for _, err := range errs {
+		level.Error(logger).Log("msg", "Invalid configuration", "err", err)
+	}
+	if len(errs) > 0 {
+		return exitConfig
+	}
+	level.Info(logger).Log("msg", "Configuration is valid")
+	return 0
+}
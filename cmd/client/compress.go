@@ -0,0 +1,80 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// acceptsGzip reports whether the Accept-Encoding header in h allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, accept := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(accept, ",") {
+			// Encodings have the same syntax as media types without a
+			// subtype.
+			encoding, params, err := mime.ParseMediaType(part)
+			if err != nil || (encoding != "gzip" && encoding != "*") {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gunzip decompresses body.
+func gunzip(body []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "error decompressing scrape response")
+	}
+	defer gz.Close()
+	decompressed, err := ioutil.ReadAll(gz)
+	return decompressed, errors.Wrap(err, "error decompressing scrape response")
+}
+
+// gzipResponse compresses the body of resp, which must not be encoded yet,
+// and sets its Content-Encoding and Content-Length to match.
+func gzipResponse(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(body); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(buf)
+	resp.ContentLength = int64(buf.Len())
+	resp.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// reloadableConfig is the part of the configuration that can be changed
+// without a restart. It's read from --config.file at startup and on
+// reloads, settings missing from the file keep the value of their flag.
+type reloadableConfig struct {
+	// Labels added to every series of successful text format scrape
+	// responses, after the transformers of --scrape.transform.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// See --scrape.response-header-timeout.
+	ScrapeResponseHeaderTimeout model.Duration `yaml:"scrape_response_header_timeout,omitempty"`
+	// See --proxy.retry.initial-wait and --proxy.retry.max-wait.
+	ProxyRetry retryConfig `yaml:"proxy_retry,omitempty"`
+	// See --push.retry.initial-wait and --push.retry.max-wait.
+	PushRetry retryConfig `yaml:"push_retry,omitempty"`
+}
+
+// retryConfig is the backoff between retries.
+type retryConfig struct {
+	InitialWait model.Duration `yaml:"initial_wait,omitempty"`
+	MaxWait     model.Duration `yaml:"max_wait,omitempty"`
+}
+
+// configFromFlags returns the reloadable configuration set by the flags.
+func configFromFlags() *reloadableConfig {
+	return &reloadableConfig{
+		ScrapeResponseHeaderTimeout: model.Duration(*scrapeResponseHeaderTimeout),
+		ProxyRetry: retryConfig{
+			InitialWait: model.Duration(*retryInitialWait),
+			MaxWait:     model.Duration(*retryMaxWait),
+		},
+		PushRetry: retryConfig{
+			InitialWait: model.Duration(*pushRetryInitialWait),
+			MaxWait:     model.Duration(*pushRetryMaxWait),
+		},
+	}
+}
+
+// restartOnlySettings maps the settings that can't be changed without a
+// restart, and so can't be in the configuration file, to their flags.
+var restartOnlySettings = map[string]string{
+	"connect_address": "--connect-address",
+	"fqdn":            "--fqdn",
+	"proxy_url":       "--proxy-url",
+}
+
+// loadConfig reads filename on top of the flags, just the flags if filename
+// is empty. Unknown settings are rejected, those that require a restart with
+// the flag to use instead.
+func loadConfig(filename string) (*reloadableConfig, error) {
+	cfg := configFromFlags()
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRestartOnly(content); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", filename)
+		}
+		if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", filename)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// checkRestartOnly fails if content has any of restartOnlySettings.
+func checkRestartOnly(content []byte) error {
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		// Reported by the strict parse.
+		return nil
+	}
+	names := make([]string, 0, len(restartOnlySettings))
+	for name := range restartOnlySettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := settings[name]; ok {
+			return errors.Errorf("%s requires a restart to change and can't be reloaded, set %s instead", name, restartOnlySettings[name])
+		}
+	}
+	return nil
+}
+
+func (c *reloadableConfig) validate() error {
+	for name := range c.Labels {
+		if err := validateLabelName(name); err != nil {
+			return err
+		}
+	}
+	if c.ScrapeResponseHeaderTimeout < 0 {
+		return errors.New("scrape_response_header_timeout must not be negative")
+	}
+	for name, retry := range map[string]retryConfig{"proxy_retry": c.ProxyRetry, "push_retry": c.PushRetry} {
+		if retry.InitialWait <= 0 || retry.MaxWait < retry.InitialWait {
+			return errors.Errorf("%s needs a positive initial_wait no larger than max_wait", name)
+		}
+	}
+	return validateWatchdogTimeout(*watchdogTimeout, c)
+}
+
+// labelTransformer returns the transformer adding the labels, or nil if
+// there are none.
+func (c *reloadableConfig) labelTransformer(logger log.Logger) BodyTransformer {
+	if len(c.Labels) == 0 {
+		return nil
+	}
+	return labelTransformer{logger: logger, labels: c.Labels}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var connectErrorCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pushprox_client_connect_errors_total",
+		Help: "Number of failed attempts to open a connection through a CONNECT proxy",
+	},
+)
+
+func init() {
+	registry.MustRegister(connectErrorCounter)
+}
+
+// parseBindAddress parses the IP address connections should originate from.
+func parseBindAddress(s string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address %q, must be an IP address", s)
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+// newDialer returns a dialer for connections originating from localAddr, or
+// from the address chosen by the system if localAddr is nil.
+func newDialer(localAddr *net.TCPAddr) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	if localAddr != nil {
+		d.LocalAddr = localAddr
+	}
+	return d
+}
+
+// dialContext returns the DialContext of d, reporting the local address in
+// errors so that failures to bind to it are obvious.
+func dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.LocalAddr == nil {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "dialing %s from %s", addr, d.LocalAddr)
+		}
+		return conn, nil
+	}
+}
+
+// checkTarget makes a single TCP connection to addr to verify that the
+// target is listening.
+func checkTarget(d *net.Dialer, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	conn, err := dialContext(d)(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// newConnectDialer returns a dial function tunneling connections through the
+// HTTP proxy at connectAddress with CONNECT, connecting to the proxy with
+// dial. connectAddress is host:port,
+// optionally prefixed with http:// and user:password@ for basic
+// authentication. TLS to the final destination, if any, is done by the
+// caller over the returned connection. Failed handshakes are attempted up
+// to maxAttempts times, waiting wait in between.
+func newConnectDialer(logger log.Logger, dial func(ctx context.Context, network, addr string) (net.Conn, error), connectAddress string, maxAttempts int, wait time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := strings.TrimPrefix(strings.TrimRight(connectAddress, "/"), "http://")
+	var auth string
+	if i := strings.LastIndex(proxyAddr, "@"); i >= 0 {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(proxyAddr[:i]))
+		proxyAddr = proxyAddr[i+1:]
+	}
+
+	connect := func(ctx context.Context, addr string) (net.Conn, error) {
+		proxyConn, err := dial(ctx, "tcp", proxyAddr)
+		if err != nil {
+			level.Error(logger).Log("msg", "dialing proxy failed", "connect_address", proxyAddr, "err", err)
+			return nil, errors.Wrapf(err, "dialing proxy %s failed", proxyAddr)
+		}
+		// Don't wait for the proxy past the deadline of the dial.
+		if deadline, ok := ctx.Deadline(); ok {
+			proxyConn.SetDeadline(deadline)
+			defer proxyConn.SetDeadline(time.Time{})
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		if err := req.Write(proxyConn); err != nil {
+			proxyConn.Close()
+			return nil, errors.Wrapf(err, "sending CONNECT to proxy %s failed", proxyAddr)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(proxyConn), req)
+		if err != nil {
+			proxyConn.Close()
+			level.Error(logger).Log("msg", "reading HTTP response from CONNECT via proxy failed",
+				"addr", addr, "connect_address", proxyAddr, "err", err)
+			return nil, errors.Wrap(err, "reading HTTP response from CONNECT via proxy failed")
+		}
+
+		if res.StatusCode != 200 {
+			proxyConn.Close()
+			level.Error(logger).Log("msg", "proxy error from server while dialing", "connect_address", proxyAddr, "addr", addr, "status", res.Status)
+			return nil, fmt.Errorf("proxy error from server while dialing %s via %s: %s", addr, proxyAddr, res.Status)
+		}
+
+		return proxyConn, nil
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for attempt := 1; ; attempt++ {
+			conn, err := connect(ctx, addr)
+			if err == nil {
+				return conn, nil
+			}
+			connectErrorCounter.Inc()
+			if attempt >= maxAttempts {
+				return nil, err
+			}
+			level.Warn(logger).Log("msg", "CONNECT via proxy failed, retrying", "connect_address", proxyAddr, "addr", addr, "attempt", attempt, "err", err)
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// withNetwork wraps dial to open "tcp" connections with network instead,
+// e.g. "tcp4" to only use IPv4.
+func withNetwork(dial func(ctx context.Context, network, addr string) (net.Conn, error), network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "" || network == "tcp" {
+		return dial
+	}
+	return func(ctx context.Context, n, addr string) (net.Conn, error) {
+		if n == "tcp" {
+			n = network
+		}
+		return dial(ctx, n, addr)
+	}
+}
+
+// withNoDelay wraps dial to set TCP_NODELAY on the connections it opens.
+func withNoDelay(dial func(ctx context.Context, network, addr string) (net.Conn, error), noDelay bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := tcpConn.SetNoDelay(noDelay); err != nil {
+				conn.Close()
+				return nil, errors.Wrap(err, "setting TCP_NODELAY")
+			}
+		}
+		return conn, nil
+	}
+}
+
+// scrapeDeadlineKey is the context key of the deadline of a scrape.
+type scrapeDeadlineKey struct{}
+
+// withScrapeDeadline stores the deadline of ctx as the scrape deadline.
+// Unlike the deadline itself, it's kept by the dial contexts of recent
+// http.Transports, which dial without the deadline of the request so that
+// the connection can be used by a later one.
+func withScrapeDeadline(ctx context.Context) context.Context {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithValue(ctx, scrapeDeadlineKey{}, deadline)
+	}
+	return ctx
+}
+
+// withDialBudget wraps dial to only let connecting take fraction of the time
+// left until the deadline of the dial context or the scrape, leaving the
+// rest for the request itself. If tlsConfig isn't nil, connecting includes
+// the TLS handshake, for use as http.Transport.DialTLSContext.
+func withDialBudget(dial func(ctx context.Context, network, addr string) (net.Conn, error), fraction float64, tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		deadline, ok := ctx.Deadline()
+		if scrapeDeadline, found := ctx.Value(scrapeDeadlineKey{}).(time.Time); found && (!ok || scrapeDeadline.Before(deadline)) {
+			deadline, ok = scrapeDeadline, true
+		}
+		if !ok {
+			return connect(ctx, dial, network, addr, tlsConfig)
+		}
+		budget := time.Duration(float64(time.Until(deadline)) * fraction)
+		dialCtx, cancel := context.WithTimeout(ctx, budget)
+		defer cancel()
+		conn, err := connect(dialCtx, dial, network, addr, tlsConfig)
+		if err != nil && dialCtx.Err() != nil && ctx.Err() == nil {
+			return nil, errors.Wrapf(err, "connecting to %s exceeded its budget of %s", addr, budget)
+		}
+		return conn, err
+	}
+}
+
+// connect dials addr and, if tlsConfig isn't nil, does the TLS handshake,
+// both within ctx.
+func connect(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "TLS handshake with %s", addr)
+	}
+	return tlsConn, nil
+}
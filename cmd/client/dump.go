@@ -0,0 +1,82 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dumpFileSuffix is the suffix of the files written by pushDumper.
+const dumpFileSuffix = ".push"
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// pushDumper writes serialized pushes to files in a directory for
+// debugging. Pushes larger than maxBytes are truncated, and the oldest files
+// are removed once there are more than maxFiles.
+type pushDumper struct {
+	dir      string
+	maxBytes int
+	maxFiles int
+
+	mu sync.Mutex
+}
+
+// dump writes body to a file named after the scrape id and the time.
+func (d *pushDumper) dump(id string, body []byte, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.maxBytes > 0 && len(body) > d.maxBytes {
+		body = body[:d.maxBytes]
+	}
+	name := fmt.Sprintf("%s-%s%s", now.UTC().Format("20060102T150405.000000000Z"), unsafeFilenameChars.ReplaceAllString(id, "_"), dumpFileSuffix)
+	if err := ioutil.WriteFile(filepath.Join(d.dir, name), body, 0600); err != nil {
+		return err
+	}
+	return d.rotate()
+}
+
+// rotate removes the oldest dumps beyond maxFiles. File names start with the
+// time, so they sort by age.
+func (d *pushDumper) rotate() error {
+	if d.maxFiles <= 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var dumps []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), dumpFileSuffix) {
+			dumps = append(dumps, e.Name())
+		}
+	}
+	sort.Strings(dumps)
+	for len(dumps) > d.maxFiles {
+		if err := os.Remove(filepath.Join(d.dir, dumps[0])); err != nil {
+			return err
+		}
+		dumps = dumps[1:]
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var featureEnabledGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pushprox_client_feature_enabled",
+		Help: "Whether an optional feature of the client is enabled (1) or not (0)",
+	}, []string{"feature"},
+)
+
+func init() {
+	registry.MustRegister(featureEnabledGauge)
+}
+
+// enabledFeatures returns which of the optional features are enabled by the
+// flags and, for those negotiated with the proxy, by its capabilities.
+func (c *Coordinator) enabledFeatures() map[string]bool {
+	return map[string]bool{
+		"openmetrics":            *openMetrics,
+		"runtime_metrics":        *runtimeMetrics,
+		"lifecycle":              *enableLifecycle,
+		"watchdog":               *watchdogTimeout > 0,
+		"poll_trace":             *tracePollTimings,
+		"push_retry":             *pushRetryMaxAttempts > 1,
+		"push_buffer":            *pushBufferSize > 0,
+		"push_error_json":        *pushErrorFormat == "json",
+		"push_compression":       c.compressPushes(),
+		"push_shared_backoff":    *pushSharedBackoff,
+		"scrape_accept_gzip":     *scrapeAcceptGzip,
+		"proxy_auth":             *proxyAuthType != "" && *proxyAuthType != "none",
+		"proxy_connect":          *connectAddr != "",
+		"scrape_connect":         *scrapeConnectAddr != "",
+		"scrape_url_rewrite":     *scrapeURLRewrite != "",
+		"scrape_forward_headers": len(*scrapeForwardHeaders) > 0,
+		"deep_ready":             *readyTargetURL != "",
+	}
+}
+
+// observeFeatures exposes which features are enabled.
+func observeFeatures(features map[string]bool) {
+	for feature, enabled := range features {
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		featureEnabledGauge.WithLabelValues(feature).Set(value)
+	}
+}
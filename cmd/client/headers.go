@@ -0,0 +1,76 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reservedStaticHeaders can't be set with --push.header and --proxy.header,
+// as the proxy relies on the values the client sets on polls and pushes.
+// The content type of polls is set with --poll.content-type instead.
+var reservedStaticHeaders = []string{"Content-Type"}
+
+// parseStaticHeaders parses headers given as Key=Value. Repeated keys add
+// values to the header.
+func parseStaticHeaders(values []string) (http.Header, error) {
+	h := http.Header{}
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q must be of the form <name>=<value>", v)
+		}
+		name, value := v[:i], v[i+1:]
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for header %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		for _, reserved := range reservedStaticHeaders {
+			if name == reserved {
+				return nil, fmt.Errorf("header %q is reserved", name)
+			}
+		}
+		h.Add(name, value)
+	}
+	return h, nil
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name,
+// i.e. a token as defined by RFC 7230.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setHeaders sets the headers in static on h, replacing any values h has.
+func setHeaders(h http.Header, static http.Header) {
+	for name, values := range static {
+		h[name] = append([]string(nil), values...)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// isTextFormat reports whether a scrape response is in the Prometheus text
+// format, the only one labels can be added to.
+func isTextFormat(h http.Header) bool {
+	return h.Get("Content-Type") == "" || expfmt.ResponseFormat(h) == expfmt.FmtText
+}
+
+// addLabels adds the labels to every series of the text format body, parsing
+// and encoding it once whatever the number of labels. Series that already
+// have a label keep their value.
+func addLabels(body []byte, labels map[string]string) ([]byte, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse scrape response")
+	}
+	names := make([]string, 0, len(families))
+	for n := range families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	labelNames := make([]string, 0, len(labels))
+	for name := range labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+
+	buf := &bytes.Buffer{}
+	for _, n := range names {
+		mf := families[n]
+		for _, m := range mf.Metric {
+			for _, name := range labelNames {
+				if !hasLabel(m, name) {
+					name, value := name, labels[name]
+					m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+				}
+			}
+		}
+		if _, err := expfmt.MetricFamilyToText(buf, mf); err != nil {
+			return nil, errors.Wrap(err, "failed to encode scrape response")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLabelName returns an error if name can't be used as a label.
+func validateLabelName(name string) error {
+	if !model.LabelName(name).IsValid() {
+		return errors.Errorf("invalid label name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// logSampler limits the logging of errors repeated in a row: the first n
+// identical errors are logged, then one per interval. It's only used by the
+// poll loop.
+type logSampler struct {
+	n        int
+	interval time.Duration
+
+	last       string
+	repeats    int
+	suppressed int
+	loggedAt   time.Time
+}
+
+// sample reports whether err, happening at now, should be logged and if so
+// how many errors weren't logged since the last one that was. With n <= 0,
+// every error is logged.
+func (s *logSampler) sample(err error, now time.Time) (bool, int) {
+	if msg := err.Error(); msg != s.last {
+		s.last, s.repeats = msg, 0
+	}
+	s.repeats++
+	if s.n > 0 && s.repeats > s.n && now.Sub(s.loggedAt) < s.interval {
+		s.suppressed++
+		return false, 0
+	}
+	suppressed := s.suppressed
+	s.suppressed, s.loggedAt = 0, now
+	return true, suppressed
+}
+
+// reset starts over after a success, returning the number of errors that
+// weren't logged since the last one that was.
+func (s *logSampler) reset() int {
+	suppressed := s.suppressed
+	*s = logSampler{n: s.n, interval: s.interval}
+	return suppressed
+}
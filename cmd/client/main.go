@@ -16,16 +16,27 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -34,35 +45,181 @@ import (
 	"github.com/cenkalti/backoff/v4"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/prometheus-community/pushprox/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 )
 
 var (
-	myFqdn      = kingpin.Flag("fqdn", "FQDN to register with").Default(fqdn.Get()).String()
-	proxyURL    = kingpin.Flag("proxy-url", "Push proxy to talk to.").Required().String()
+	runCommand         = kingpin.Command("run", "Run the client.").Default()
+	checkConfigCommand = kingpin.Command("check-config", "Check the flags and --config.file without connecting anywhere, then exit with 0 if they are valid.")
+
+	myFqdn      = kingpin.Flag("fqdn", "FQDN to register with, looked up from the hostname if unset").String()
+	proxyURL    = kingpin.Flag("proxy-url", "Push proxy to talk to.").String()
 	caCertFile  = kingpin.Flag("tls.cacert", "<file> CA certificate to verify peer against").String() // Q: isn't this authentication?
-	tlsCert     = kingpin.Flag("tls.cert", "<cert> Client certificate file").String() // isn't this certification?
+	tlsCert     = kingpin.Flag("tls.cert", "<cert> Client certificate file").String()                 // isn't this certification?
 	tlsKey      = kingpin.Flag("tls.key", "<key> Private key file").String()
-	metricsAddr = kingpin.Flag("metrics-addr", "Serve Prometheus metrics at this address").Default(":9369").String()
-	connectAddr	= kingpin.Flag("connect-address", "Host address with port for HTTP connect.").String()
-	localScrape	= kingpin.Flag("local-scrape", "Define to use local host as scrape target.").String()
+	metricsAddr = kingpin.Flag("metrics-addr", "Serve Prometheus metrics at this address. Can be repeated to listen on several addresses.").Default(":9369").Strings()
+	openMetrics = kingpin.Flag("metrics.openmetrics", "Serve the client's metrics in the OpenMetrics format if requested by the scraper.").Bool()
+	healthAddr  = kingpin.Flag("web.health-addr", "Serve /-/healthy and /-/ready at this address instead of --metrics-addr.").String()
+	connectAddr = kingpin.Flag("connect-address", "Host address with port for HTTP connect.").String()
+	localScrape = kingpin.Flag("local-scrape", "Define to use local host as scrape target.").String()
+	pollPath    = kingpin.Flag("proxy.poll-path", "Path of the poll endpoint, relative to --proxy-url.").Default("poll").String()
+	pushPath    = kingpin.Flag("proxy.push-path", "Path of the push endpoint, relative to --proxy-url.").Default("push").String()
+
+	pollContentType = kingpin.Flag("proxy.poll-content-type", "Content-Type of polls, whose body is the FQDN of the client. Pushes are sent as message/http.").Default("text/plain").String()
+
+	localScrapeAllowedPorts = kingpin.Flag("local-scrape.allowed-ports", "Only scrape this local port with --local-scrape. Can be repeated. All ports are allowed if unset.").Strings()
+	selfMetricsPath         = kingpin.Flag("self-metrics-path", "Path on --metrics-addr, e.g. /metrics, that may still be scraped when --local-scrape or --scrape.url-rewrite map a target onto it. Other scrapes mapped onto --metrics-addr are refused.").String()
+
+	fqdnDisableLookup = kingpin.Flag("fqdn.disable-lookup", "Don't look up the FQDN from the hostname, --fqdn has to be set instead.").Bool()
+
+	readyTargetURL = kingpin.Flag("web.ready-target-url", "URL of the local target to scrape for deep readiness checks on /-/ready?deep=true, e.g. http://localhost:9100/metrics. Defaults to /metrics on the first --local-scrape.allowed-ports on localhost with --local-scrape.").String()
+	preferProtobuf = kingpin.Flag("metrics.prefer-protobuf", "Serve the client's metrics in the delimited protobuf format whenever the scraper accepts it, even if it prefers another format.").Bool()
+	runtimeMetrics = kingpin.Flag("metrics.include-runtime", "Include the Go runtime and process metrics in the client's metrics.").Default("true").Bool()
+
+	tlsMinVersion   = kingpin.Flag("tls.min-version", "Minimum TLS version for connections to the proxy and scrape targets: 1.0, 1.1, 1.2 or 1.3. Defaults to the Go default.").String()
+	tlsCipherSuites = kingpin.Flag("tls.cipher-suites", "TLS cipher suite to allow for TLS 1.2 and earlier, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Can be repeated. TLS 1.3 cipher suites aren't configurable. Defaults to the Go default.").Strings()
+	proxyTLSPins    = kingpin.Flag("proxy.tls.pin", "SHA-256 fingerprint, in hex, of a certificate to accept from the proxy, in addition to verifying it against --tls.cacert. Can be repeated, e.g. to pin the current and the next certificate while rotating.").Strings()
+
+	metricsDisableKeepAlives = kingpin.Flag("metrics.disable-keepalives", "Close connections to --metrics-addr after every request instead of keeping them open for the next scrape, to save memory when scraped rarely.").Bool()
+
+	metricsMaxTargets = kingpin.Flag("metrics.max-targets", "Maximum number of distinct targets in the target label of the client's metrics, further targets are labeled \"other\". 0 means no limit.").Default("100").Int()
+
+	proxyURLFile      = kingpin.Flag("proxy-url-file", "File containing the URL of the push proxy to talk to, read at startup. Reloads fail once it holds a different URL, as changing the proxy requires a restart. Alternative to --proxy-url.").String()
+	scrapeURLRewrite  = kingpin.Flag("scrape.url-rewrite", "Rewrite scrape target URLs as <regex>=<replacement>, e.g. ':9100/=:9101/'. Applied after --local-scrape.").String()
+	scrapeTCPNoDelay  = kingpin.Flag("scrape.tcp-nodelay", "Disable Nagle's algorithm on scrape connections, as Go does by default.").Default("true").Bool()
+	scrapeBindAddress = kingpin.Flag("scrape.bind-address", "Local IP address to originate scrape connections from.").String()
+	proxyBindAddress  = kingpin.Flag("proxy.bind-address", "Local IP address to originate proxy connections from.").String()
+
+	scrapeDialBudgetFraction = kingpin.Flag("scrape.dial-budget-fraction", "Fraction of the remaining scrape timeout that connecting to a scrape target, including the TLS handshake, may take, e.g. 0.5. 0 lets connecting take the whole timeout.").Default("0").Float64()
+	scrapeFreshConnections   = kingpin.Flag("scrape.fresh-connections", "Open a new connection for every scrape instead of reusing idle ones, for targets behind firewalls that silently drop idle connections. Every scrape then pays for a TCP, and TLS if used, handshake.").Bool()
+
+	scrapeDisableExpectContinue = kingpin.Flag("scrape.disable-expect-continue", "Drop the Expect: 100-continue header from scrape requests and send their body right away, for targets that don't handle it well.").Bool()
+
+	proxyAuthType            = kingpin.Flag("proxy.auth-type", "How to authenticate to the proxy.").Default("none").Enum("none", "basic", "bearer", "hmac")
+	proxyAuthUsername        = kingpin.Flag("proxy.auth.username", "Username for basic authentication to the proxy.").String()
+	proxyAuthCredentialsFile = kingpin.Flag("proxy.auth.credentials-file", "File holding the password, bearer token or HMAC secret to authenticate to the proxy with.").String()
+	proxySignRegistration    = kingpin.Flag("proxy.sign-registration", "Sign the FQDN and time of polls with the key of --tls.cert, so that proxies can check that the client owns the FQDN it registers even behind TLS termination. The certificate must be valid for the FQDN.").Bool()
+
+	strictConfig  = kingpin.Flag("strict-config", "Exit at startup on configuration problems that are otherwise only logged as warnings, e.g. a scrape target mapped onto --metrics-addr.").Bool()
+	requireTarget = kingpin.Flag("startup.require-target", "Exit at startup if no TCP connection can be made to this <host:port>, e.g. the local target used with --local-scrape.").String()
+
+	connectRetryMaxAttempts = kingpin.Flag("connect.retry.max-attempts", "Maximum number of attempts to open a connection through the CONNECT proxy of --connect-address or --scrape.connect-address. 1 disables retries.").Default("1").Int()
+	connectRetryWait        = kingpin.Flag("connect.retry.wait", "Amount of time to wait between attempts to open a connection through a CONNECT proxy.").Default("1s").Duration()
+
+	scrapeConnectAddr = kingpin.Flag("scrape.connect-address", "Host address with port of an HTTP proxy to tunnel scrape connections through with CONNECT, optionally with user:password@ for basic authentication.").String()
+	scrapeServerName  = kingpin.Flag("scrape.tls.server-name", "Server name to verify the certificates of HTTPS scrape targets against, and to send as SNI, instead of the target host.").String()
+
+	scrapeWarnBodyBytes  = kingpin.Flag("scrape.warn-body-bytes", "Log a warning when a scrape response body is larger than this many bytes. The response is pushed anyway. 0 disables the warning.").Default("0").Int()
+	scrapeAddFQDNLabel   = kingpin.Flag("scrape.add-fqdn-label", "Add a label with this name and the FQDN as value to every series of text format scrape responses. Series that already have the label keep it.").String()
+	scrapeMaxHeaderBytes = kingpin.Flag("scrape.max-header-bytes", "Fail scrapes whose response headers are larger than this many bytes instead of pushing them. 0 uses Go's default limit of 1MiB.").Default("0").Int64()
+	scrapeHostHeader     = kingpin.Flag("scrape.host-header", "Host header to send to scrape targets instead of the one of the scrape request.").String()
+	scrapeForwardHeaders = kingpin.Flag("scrape.forward-headers", "Only forward this header of scrape requests to scrape targets, in addition to Accept, X-Prometheus-Scrape-Timeout-Seconds and X-PushProx-Client-Request-Id. Can be repeated. All headers are forwarded if unset.").Strings()
+
+	scrapeDialNetwork = kingpin.Flag("scrape.dial-network", "Network to open scrape connections with: tcp for IPv4 and IPv6, tcp4 for IPv4 only or tcp6 for IPv6 only. With --scrape.connect-address, this applies to the connection to the CONNECT proxy.").Default("tcp").Enum("tcp", "tcp4", "tcp6")
+	proxyDialNetwork  = kingpin.Flag("proxy.dial-network", "Network to open connections to the proxy with: tcp for IPv4 and IPv6, tcp4 for IPv4 only or tcp6 for IPv6 only. With --connect-address, this applies to the connection to the CONNECT proxy.").Default("tcp").Enum("tcp", "tcp4", "tcp6")
+
+	scrapeMaxForwardHeaders = kingpin.Flag("scrape.max-forward-headers", "Forward at most this many headers of scrape requests to scrape targets, dropping the others. Accept, X-Prometheus-Scrape-Timeout-Seconds and X-PushProx-Client-Request-Id are kept first. 0 forwards all headers.").Default("0").Int()
+
+	scrapeAcceptGzip = kingpin.Flag("scrape.accept-gzip", "Ask scrape targets for gzip compressed responses. They are decompressed before being pushed, see --push.compression.").Default("true").Bool()
+
+	scrapeResponseHeaderTimeout = kingpin.Flag("scrape.response-header-timeout", "Fail scrapes if the target doesn't send the response headers within this time, even if the scrape timeout is longer. Reading the body is only limited by the scrape timeout. 0 disables the limit.").Default("0s").Duration()
+
+	preScrapeCommand       = kingpin.Flag("scrape.pre-scrape-command", "Executable to run before scrapes, whose output is sent to scrape targets in the header of --scrape.pre-scrape-command-header, e.g. to mint credentials. It is run without a shell or arguments, at most once per --scrape.pre-scrape-command-ttl, and must finish within the scrape timeout.").String()
+	preScrapeCommandHeader = kingpin.Flag("scrape.pre-scrape-command-header", "Header to send the output of --scrape.pre-scrape-command in, e.g. Authorization if it prints \"Bearer <token>\".").Default("Authorization").String()
+	preScrapeCommandTTL    = kingpin.Flag("scrape.pre-scrape-command-ttl", "How long to use the output of --scrape.pre-scrape-command before running it again.").Default("5m").Duration()
+
+	scrapeTransformers = kingpin.Flag("scrape.transform", "Transformation to apply to the bodies of successful scrape responses, in the order given: add-fqdn-label (see --scrape.add-fqdn-label) or validate (fail scrapes that aren't valid text format). Can be repeated. Defaults to add-fqdn-label if --scrape.add-fqdn-label is set.").Enums("add-fqdn-label", "validate")
+
+	pushHeaderFlags  = kingpin.Flag("push.header", "Header to set on pushes to the proxy, as <name>=<value>, e.g. for routing by a gateway in front of the proxy. Can be repeated.").Strings()
+	proxyHeaderFlags = kingpin.Flag("proxy.header", "Header to set on polls and pushes to the proxy, as <name>=<value>. Can be repeated. Content-Type can't be set.").Strings()
+
+	scrapeBearerTokenFile = kingpin.Flag("scrape.bearer-token-file", "File containing a bearer token to send to scrape targets, re-read every minute to pick up rotated tokens. It is never sent to the proxy.").String()
 
 	retryInitialWait = kingpin.Flag("proxy.retry.initial-wait", "Amount of time to wait after proxy failure").Default("1s").Duration()
 	retryMaxWait     = kingpin.Flag("proxy.retry.max-wait", "Maximum amount of time to wait between proxy poll retries").Default("5s").Duration()
 
+	retryProtocolErrorWait = kingpin.Flag("proxy.retry.protocol-error-wait", "Amount of time to wait before polling again after the proxy rejected a poll with 400, 401 or 403. 0 uses the normal backoff.").Default("1m").Duration()
+
+	maxPollResponseBytes  = kingpin.Flag("proxy.max-poll-response-bytes", "Fail polls whose response is larger than this many bytes. 0 means unlimited.").Default("1048576").Int64()
+	maxPollFailures       = kingpin.Flag("proxy.max-consecutive-poll-failures", "Exit after this many polls in a row failed, so that the client gets restarted. 0 means never exit.").Default("0").Int()
+	pollStartupJitter     = kingpin.Flag("poll.startup-jitter", "Wait for a random amount of time up to this before the first poll.").Default("1s").Duration()
+	pollMinInterval       = kingpin.Flag("poll.min-interval", "Minimum amount of time between the start of two polls, to avoid a busy loop against a proxy that doesn't hold polls open. 0 means no minimum.").Default("0s").Duration()
+	pollAdaptiveFloor     = kingpin.Flag("poll.adaptive-floor", "Raise the minimum time between polls, up to --proxy.retry.max-wait, while polls keep failing and lower it again as they succeed, to save CPU when the proxy fails fast.").Bool()
+	tracePollTimings      = kingpin.Flag("trace.poll-timings", "Record DNS, connect, TLS and time to first byte timings of polls.").Bool()
+	maxPollsPerConnection = kingpin.Flag("proxy.max-polls-per-connection", "Close idle proxy connections after this many successful polls, so that the next poll uses a fresh connection. 0 means unlimited.").Default("0").Int()
+
+	enableLifecycle     = kingpin.Flag("web.enable-lifecycle", "Enable reloading via HTTP request on /-/reload, shutdown on /-/quit, and pausing and resuming scraping on /-/pause and /-/resume.").Bool()
+	shutdownGracePeriod = kingpin.Flag("shutdown.grace-period", "Maximum amount of time to wait for in-flight scrapes to finish when shutting down").Default("30s").Duration()
+
+	configFile         = kingpin.Flag("config.file", "YAML file with the settings that can be changed without a restart, re-read on reload: labels, scrape_response_header_timeout, proxy_retry and push_retry. Settings missing from the file keep the value of their flag.").String()
+	reloadDrainTimeout = kingpin.Flag("reload.drain-timeout", "Maximum amount of time to wait for in-flight scrapes to finish before applying a reload").Default("30s").Duration()
+	watchdogTimeout    = kingpin.Flag("watchdog.timeout", "Exit if no poll has been attempted for this long, so that a stalled client gets restarted. Must be larger than the waits between polls, including --proxy.retry.protocol-error-wait and --reload.drain-timeout, and than the longest the proxy holds a poll open, i.e. the longest scrape interval of the client's targets. Paused while a reload drains scrapes. 0 disables the watchdog.").Default("0s").Duration()
+
+	heartbeatInterval = kingpin.Flag("log.heartbeat-interval", "Log the time of the last successful poll, the number of scrapes and the poll backoff at this interval. 0 disables the heartbeat.").Default("0s").Duration()
+
+	pollErrorLogSample = kingpin.Flag("log.poll-error-sample", "After this many identical poll errors in a row, only log one per minute along with the number of errors not logged, until polling works again. 0 logs every poll error.").Default("0").Int()
+
+	tlsReloadInterval = kingpin.Flag("tls.reload-interval", "How often to check --tls.cacert for changes and reload the CA certificates, independently of /-/reload. 0 disables the checks.").Default("0s").Duration()
+
+	pushRetryMaxAttempts = kingpin.Flag("push.retry.max-attempts", "Maximum number of attempts to push a scrape result, retries stop at the scrape deadline. 1 disables retries.").Default("1").Int()
+	pushRetryInitialWait = kingpin.Flag("push.retry.initial-wait", "Amount of time to wait after a push failure").Default("500ms").Duration()
+	pushRetryMaxWait     = kingpin.Flag("push.retry.max-wait", "Maximum amount of time to wait between push retries").Default("5s").Duration()
+	pushErrorFormat      = kingpin.Flag("push.error-format", "Format of the body of pushed scrape errors.").Default("text").Enum("text", "json")
+	pushGatewayStatus    = kingpin.Flag("push.gateway-status", "Push failed scrapes that didn't reach the target with 502 Bad Gateway, e.g. for DNS, connection refused or TLS errors, or 504 Gateway Timeout for timeouts, instead of 500.").Bool()
+	addClientRequestID   = kingpin.Flag("push.add-client-request-id", "Add a unique X-PushProx-Client-Request-Id header to every scrape request and its push, in addition to the id of the proxy.").Bool()
+	pushSharedBackoff    = kingpin.Flag("push.shared-backoff", "Delay all pushes after pushes failed, backing off from --push.retry.initial-wait up to --push.retry.max-wait, to protect an overloaded proxy.").Bool()
+	pushCompression      = kingpin.Flag("push.compression", "Compress pushed scrape responses if Prometheus accepts it: gzip, none, or auto to only compress once the proxy advertised that it supports compressed pushes. Independent of --scrape.accept-gzip.").Default("gzip").Enum("none", "gzip", "auto")
+	pushConnectionClose  = kingpin.Flag("push.connection-close", "Close the connection to the proxy after every push instead of reusing it. Works around proxies that run out of connections, at the cost of a new connection, and TLS handshake, per push.").Bool()
+	pushMetadataHeaders  = kingpin.Flag("push.metadata-headers", "Add X-PushProx-Scrape-Duration-Seconds and X-PushProx-Scrape-Bytes headers with the duration and uncompressed body size of the scrape to pushed responses, for the proxy to log or expose.").Bool()
+	pushBufferSize       = kingpin.Flag("push.buffer-size", "Number of failed pushes to keep in memory and retry after the next successful push. 0 disables buffering.").Default("0").Int()
+	pushBufferTTL        = kingpin.Flag("push.buffer-ttl", "Drop buffered pushes older than this, or earlier once their scrape timed out.").Default("1m").Duration()
+
+	dumpPushesDir      = kingpin.Flag("debug.dump-pushes-dir", "Write every push to a file in this directory, for debugging.").String()
+	dumpPushesMaxBytes = kingpin.Flag("debug.dump-pushes-max-bytes", "Truncate dumped pushes to this many bytes. 0 means unlimited.").Default("1048576").Int()
+	dumpPushesMaxFiles = kingpin.Flag("debug.dump-pushes-max-files", "Remove the oldest dumped pushes beyond this many files. 0 means unlimited.").Default("100").Int()
 )
 
 var (
-	scrapeErrorCounter = prometheus.NewCounter(
+	scrapeErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pushprox_client_scrape_errors_total",
 			Help: "Number of scrape errors",
-		},
+		}, []string{"type"},
+	)
+	largeScrapeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_large_scrape_total",
+			Help: "Number of scrape responses larger than --scrape.warn-body-bytes",
+		}, []string{"target"},
+	)
+	scrapeConsecutiveFailuresGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_scrape_consecutive_failures",
+			Help: "Number of scrapes of the target that failed in a row, reset when the target responds",
+		}, []string{"target"},
+	)
+	scrapeTimeoutsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrape_timeouts_total",
+			Help: "Number of scrapes of the target that failed because the scrape timeout expired",
+		}, []string{"target"},
+	)
+	lastSuccessfulPushGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_last_successful_push_timestamp_seconds",
+			Help: "Time of the last successful push of a scrape of the target",
+		}, []string{"target"},
+	)
+	scrapeResponseStatusCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrape_response_status_total",
+			Help: "Number of responses from scrape targets by class of HTTP status code",
+		}, []string{"code"},
 	)
 	pushErrorCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -76,13 +233,93 @@ var (
 			Help: "Number of poll errors",
 		},
 	)
+	scrapesInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_scrapes_in_flight",
+			Help: "Number of scrapes currently being handled",
+		},
+	)
+	pollBackoffGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_poll_backoff_current_seconds",
+			Help: "Time to wait before retrying a failed poll",
+		},
+	)
+	scrapeHeadersTooLargeCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrape_headers_too_large_total",
+			Help: "Number of scrapes failed because the response headers exceeded --scrape.max-header-bytes",
+		},
+	)
+	pollResponseBytesHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_poll_response_bytes",
+			Help:    "Size of the scrape requests read from poll responses, after decompression",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+	)
+	pollParseDurationHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pushprox_client_poll_parse_duration_seconds",
+			Help: "Time taken reading and parsing the scrape requests of poll responses",
+		},
+	)
+	pollRTTHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_poll_rtt_seconds",
+			Help:    "Time from sending a poll to the proxy until the scrape request in its response was read",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		},
+	)
+	preScrapeCommandFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_pre_scrape_command_failures_total",
+			Help: "Number of failed runs of --scrape.pre-scrape-command",
+		},
+	)
+	localScrapeRewritesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_local_scrape_rewrites_total",
+			Help: "Number of scrape targets rewritten to localhost by --local-scrape",
+		},
+	)
+	localScrapeRewritesSkippedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_local_scrape_rewrites_skipped_total",
+			Help: "Number of scrape targets not rewritten to localhost by --local-scrape because they have no port",
+		},
+	)
+	repollsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_unknown_scrape_repolls_total",
+			Help: "Number of times the client polled again right away because the proxy didn't know a pushed scrape, e.g. after a proxy restart",
+		},
+	)
+	pausedGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_paused",
+			Help: "Whether scraping is paused via /-/pause",
+		},
+	)
+	reloadsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_reloads_total",
+			Help: "Number of applied configuration reloads",
+		},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(pushErrorCounter, pollErrorCounter, scrapeErrorCounter)
+	registry.MustRegister(pushErrorCounter, pollErrorCounter, scrapeErrorCounter, scrapeResponseStatusCounter, largeScrapeCounter, scrapeConsecutiveFailuresGauge, scrapeTimeoutsCounter, lastSuccessfulPushGauge, scrapeHeadersTooLargeCounter, scrapesInFlightGauge, pollBackoffGauge, pollResponseBytesHistogram, pollParseDurationHistogram, pollRTTHistogram, preScrapeCommandFailuresCounter, localScrapeRewritesCounter, localScrapeRewritesSkippedCounter, pausedGauge, repollsCounter, reloadsCounter)
+	for _, t := range errorTypes {
+		scrapeErrorCounter.WithLabelValues(t)
+	}
+	for _, class := range []string{"1xx", "2xx", "3xx", "4xx", "5xx"} {
+		scrapeResponseStatusCounter.WithLabelValues(class)
+	}
 }
 
-func newBackOffFromFlags() backoff.BackOff {
+func newBackOffFromFlags() *backoff.ExponentialBackOff {
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = *retryInitialWait
 	b.Multiplier = 1.5
@@ -91,19 +328,836 @@ func newBackOffFromFlags() backoff.BackOff {
 	return b
 }
 
+// newPushBackOff returns the backoff used to retry failed pushes, waiting as
+// set by retry. Retries are never scheduled past the deadline of ctx, as
+// Prometheus will have given up on the scrape by then. Push errors have to be
+// passed to the returned retryAfterBackOff, so that Retry-After from the
+// proxy is honoured.
+func newPushBackOff(ctx context.Context, retry retryConfig) (backoff.BackOff, *retryAfterBackOff) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Duration(retry.InitialWait)
+	b.Multiplier = 1.5
+	b.MaxInterval = time.Duration(retry.MaxWait)
+	b.MaxElapsedTime = time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		b.MaxElapsedTime = time.Until(deadline)
+	}
+	retryAfter := &retryAfterBackOff{BackOff: b, max: time.Duration(retry.MaxWait)}
+	retries := 0
+	if *pushRetryMaxAttempts > 1 {
+		retries = *pushRetryMaxAttempts - 1
+	}
+	return backoff.WithContext(backoff.WithMaxRetries(retryAfter, uint64(retries)), ctx), retryAfter
+}
+
+// Exit codes for failures at startup, 1 is used for everything else.
+const (
+	exitConfig       = 2
+	exitTLS          = 3
+	exitConnectivity = 4
+)
+
+// pathFlags are the flags holding file paths, environment variables in them
+// are expanded at startup.
+var pathFlags = []struct {
+	name  string
+	value *string
+}{
+	{"tls.cacert", caCertFile},
+	{"tls.cert", tlsCert},
+	{"tls.key", tlsKey},
+	{"proxy-url-file", proxyURLFile},
+	{"proxy.auth.credentials-file", proxyAuthCredentialsFile},
+	{"debug.dump-pushes-dir", dumpPushesDir},
+	{"scrape.bearer-token-file", scrapeBearerTokenFile},
+	{"scrape.pre-scrape-command", preScrapeCommand},
+}
+
+// expandPathFlags expands environment variables in the path flags, failing
+// if a path expands to nothing.
+func expandPathFlags(logger log.Logger) error {
+	for _, f := range pathFlags {
+		if *f.value == "" {
+			continue
+		}
+		expanded := os.ExpandEnv(*f.value)
+		if expanded == "" {
+			return fmt.Errorf("--%s=%q expands to an empty path", f.name, *f.value)
+		}
+		level.Info(logger).Log("msg", "Resolved file path", "flag", f.name, "path", expanded)
+		*f.value = expanded
+	}
+	return nil
+}
+
+// scrapeTransformerNames returns the names of the transformers of
+// --scrape.transform, which defaults to add-fqdn-label with
+// --scrape.add-fqdn-label.
+func scrapeTransformerNames() []string {
+	if len(*scrapeTransformers) == 0 && *scrapeAddFQDNLabel != "" {
+		return []string{"add-fqdn-label"}
+	}
+	return *scrapeTransformers
+}
+
+// resolveFQDN looks up the FQDN to register with, unless it was set.
+func resolveFQDN(logger log.Logger, lookup func() string) error {
+	if *myFqdn != "" {
+		level.Info(logger).Log("msg", "Using FQDN", "fqdn", *myFqdn, "source", "flag")
+		return nil
+	}
+	if *fqdnDisableLookup {
+		return errors.New("--fqdn is required with --fqdn.disable-lookup")
+	}
+	start := time.Now()
+	*myFqdn = lookup()
+	level.Info(logger).Log("msg", "Using FQDN", "fqdn", *myFqdn, "source", "lookup", "duration", time.Since(start))
+	return nil
+}
+
+// readProxyURLFile reads the proxy URL from a file holding a single line.
+func readProxyURLFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	proxyURL := strings.TrimSpace(string(content))
+	if proxyURL == "" {
+		return "", fmt.Errorf("no proxy url in %s", filename)
+	}
+	if strings.ContainsAny(proxyURL, "\r\n") {
+		return "", fmt.Errorf("%s must contain a single line", filename)
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid proxy url in %s", filename)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid proxy url %q in %s", proxyURL, filename)
+	}
+	return proxyURL, nil
+}
+
+// checkProxyURLFile fails if filename no longer holds current, the proxy URL
+// the client started with.
+func checkProxyURLFile(filename, current string) error {
+	proxyURL, err := readProxyURLFile(filename)
+	if err != nil {
+		return err
+	}
+	if strings.TrimRight(proxyURL, "/") != strings.TrimRight(current, "/") {
+		return fmt.Errorf("proxy url in %s changed to %q, which requires a restart", filename, proxyURL)
+	}
+	return nil
+}
+
+// validateEndpointPath makes sure that path stays below the proxy URL once
+// resolved against it.
+func validateEndpointPath(p string) error {
+	u, err := url.Parse(p)
+	if err != nil {
+		return err
+	}
+	if u.IsAbs() || u.Host != "" || strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("path %q must be relative", p)
+	}
+	if u.Path == "" {
+		return fmt.Errorf("path %q must not be empty", p)
+	}
+	if cleaned := path.Clean(u.Path); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("path %q escapes the proxy url", p)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // Coordinator for scrape requests and responses
 type Coordinator struct {
 	logger log.Logger
+
+	mu sync.Mutex
+	// Capabilities advertised by the proxy, nil until the first poll.
+	capabilities util.Capabilities
+	// When the last poll was started.
+	lastPollAttempt time.Time
+	// When the last poll succeeded and the error of the last poll.
+	lastSuccessfulPoll time.Time
+	lastPollError      error
+	// Number of scrapes being handled.
+	scrapesInFlight int
+	// Whether scrape requests are answered without scraping.
+	paused bool
+	// Failed scrapes in a row by target label.
+	scrapeFailureStreaks map[string]int
+	// Number of scrapes started since the last heartbeat.
+	scrapesSinceHeartbeat int
+	// Time to wait before the next poll after a failure.
+	pollBackoff time.Duration
+
+	// The reloadable configuration, nil for just the flags.
+	config *reloadableConfig
+
+	// Held for writing while draining, to stop new polls.
+	pollGate sync.RWMutex
+	// Whether a drain is in progress.
+	draining bool
+	// Rewrite applied to scrape target URLs, if any.
+	urlRewrite *urlRewrite
+	// Failed pushes to retry once pushing works again, nil if disabled.
+	pushBuffer *pushBuffer
+	// Base URL of the proxy, ending with a '/'.
+	proxyURL string
+	// Successful polls since the idle proxy connections were last closed,
+	// only used by the poll loop.
+	pollsSinceReconnect int
+	// Failed polls since the last successful one, only used by the poll loop.
+	consecutivePollFailures int
+	// Ids of recently received scrape requests.
+	scrapeIDs recentIDs
+	// Authenticates requests to the proxy, nil if there is no authentication.
+	authenticator ProxyAuthenticator
+	// Writes pushes to disk for debugging, nil if disabled.
+	pushDumper *pushDumper
+	// Delays all pushes while pushing fails, nil if disabled.
+	pushGate *pushGate
+	// Bounds the number of targets in metric labels, nil if unlimited.
+	targetLabels *targetLabeler
+	// Applied in order to the bodies of successful scrape responses.
+	bodyTransformers []BodyTransformer
+	// Bearer token sent to scrape targets, nil if disabled.
+	scrapeToken *tokenFile
+	// Header value for scrape targets printed by a command, nil if disabled.
+	preScrapeToken *commandToken
+	// Static headers set on polls and pushes.
+	pollHeaders, pushHeaders http.Header
+	// Scrapes being handled, for /-/scrapes.
+	inFlight inFlightScrapes
+	// Cuts short the wait before the next poll, set by the poll loop.
+	cancelPollWait context.CancelFunc
+	// Signs poll registrations, nil if disabled.
+	registrationCert *tls.Certificate
+}
+
+// authenticate adds the credentials for the proxy to r.
+func (c *Coordinator) authenticate(r *http.Request) error {
+	if c.authenticator == nil {
+		return nil
+	}
+	return errors.Wrap(c.authenticator.Apply(r), "error authenticating to proxy")
+}
+
+// setProxyURL sets the URL of the proxy to talk to.
+func (c *Coordinator) setProxyURL(proxyURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Make sure proxyURL ends with a single '/'
+	c.proxyURL = strings.TrimRight(proxyURL, "/") + "/"
+}
+
+func (c *Coordinator) getProxyURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proxyURL
+}
+
+// proxyEndpoint resolves path against the proxy URL.
+func (c *Coordinator) proxyEndpoint(path string) (*url.URL, error) {
+	return resolveEndpoint(c.getProxyURL(), path)
+}
+
+// pollSourceKey is the context key of the URL of the proxy a scrape request
+// was polled from.
+type pollSourceKey struct{}
+
+// pushEndpoint returns the URL to push the response of the scrape request
+// with context ctx to. Responses are pushed to the proxy the request was
+// polled from, as only that proxy waits for them, even if the proxy URL has
+// been reloaded since. Pushes without a poll source, e.g. buffered ones, go
+// to the current proxy.
+func (c *Coordinator) pushEndpoint(ctx context.Context) (*url.URL, error) {
+	if proxyURL, ok := ctx.Value(pollSourceKey{}).(string); ok {
+		return resolveEndpoint(proxyURL, *pushPath)
+	}
+	return c.proxyEndpoint(*pushPath)
+}
+
+// resolveEndpoint resolves path against proxyURL.
+func resolveEndpoint(proxyURL, path string) (*url.URL, error) {
+	base, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing url %s", path)
+	}
+	return base.ResolveReference(u), nil
+}
+
+func (c *Coordinator) addScrapesInFlight(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scrapesInFlight += delta
+	if delta > 0 {
+		c.scrapesSinceHeartbeat += delta
+	}
+	scrapesInFlightGauge.Add(float64(delta))
+}
+
+func (c *Coordinator) getScrapesInFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scrapesInFlight
+}
+
+// errDrainInProgress is returned when draining while another drain is still
+// waiting for scrapes.
+var errDrainInProgress = errors.New("already draining scrapes for a reload")
+
+// drain stops issuing new polls, waits up to timeout for the in-flight
+// scrapes to finish and runs fn before polling resumes. It fails right away
+// with errDrainInProgress rather than queueing behind another drain, so that
+// piled up reloads can't keep the client from polling.
+func (c *Coordinator) drain(timeout time.Duration, fn func()) error {
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		return errDrainInProgress
+	}
+	c.draining = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.draining = false
+		// The watchdog starts over once polling resumes.
+		c.lastPollAttempt = time.Now()
+		c.mu.Unlock()
+	}()
+
+	c.pollGate.Lock()
+	defer c.pollGate.Unlock()
+	c.waitForScrapes(timeout)
+	fn()
+	return nil
+}
+
+// stop stops issuing new polls for good and waits up to timeout for the
+// in-flight scrapes to finish.
+func (c *Coordinator) stop(timeout time.Duration) {
+	c.pollGate.Lock()
+	c.waitForScrapes(timeout)
+}
+
+// waitForScrapes waits up to timeout for the in-flight scrapes to finish.
+func (c *Coordinator) waitForScrapes(timeout time.Duration) {
+	level.Info(c.logger).Log("msg", "Draining scrapes", "scrapes_in_flight", c.getScrapesInFlight())
+	deadline := time.Now().Add(timeout)
+	for c.getScrapesInFlight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := c.getScrapesInFlight(); n > 0 {
+		level.Warn(c.logger).Log("msg", "Timed out draining scrapes", "scrapes_in_flight", n)
+	}
+}
+
+func (c *Coordinator) recordPollResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPollError = err
+	if err == nil {
+		c.lastSuccessfulPoll = time.Now()
+	} else {
+		pollErrorCounter.Inc()
+	}
+}
+
+// notifyPollSuccess resets the time to wait before the next poll and the
+// sampling of poll error logs.
+func (c *Coordinator) notifyPollSuccess(errorLog *logSampler) {
+	c.setPollBackoff(time.Duration(c.getConfig().ProxyRetry.InitialWait))
+	if suppressed := errorLog.reset(); suppressed > 0 {
+		level.Info(c.logger).Log("msg", "Polling works again", "suppressed_errors", suppressed)
+	}
+}
+
+// notifyPollError logs a failed poll unless errorLog suppresses it, and
+// records the time to wait before the next one.
+func (c *Coordinator) notifyPollError(errorLog *logSampler, err error, next time.Duration, now time.Time) {
+	c.setPollBackoff(next)
+	ok, suppressed := errorLog.sample(err, now)
+	if !ok {
+		return
+	}
+	class := errorClass(err)
+	logger := log.With(c.logger, "class", class, "err", err, "retry_in", next, "suppressed_errors", suppressed)
+	switch class {
+	case "overload":
+		level.Warn(logger).Log("msg", "Proxy rejected poll, retrying")
+	case "protocol":
+		level.Error(logger).Log("msg", "Proxy rejected poll, check the client configuration")
+	default:
+		level.Warn(logger).Log("msg", "Poll failed, retrying")
+	}
+}
+
+// countPollForReconnect counts a successful poll, closing the idle
+// connections of proxyClient every --proxy.max-polls-per-connection polls so
+// that the next one uses a fresh connection. Only used by the poll loop.
+func (c *Coordinator) countPollForReconnect(proxyClient *http.Client) {
+	if *maxPollsPerConnection <= 0 {
+		return
+	}
+	c.pollsSinceReconnect++
+	if c.pollsSinceReconnect >= *maxPollsPerConnection {
+		level.Debug(c.logger).Log("msg", "Closing idle proxy connections", "polls", c.pollsSinceReconnect)
+		c.pollsSinceReconnect = 0
+		proxyClient.CloseIdleConnections()
+	}
+}
+
+// tooManyPollFailures counts the polls failed in a row, reporting whether
+// there were --proxy.max-consecutive-poll-failures of them. Only used by the
+// poll loop.
+func (c *Coordinator) tooManyPollFailures(err error) bool {
+	if err == nil {
+		c.consecutivePollFailures = 0
+		return false
+	}
+	c.consecutivePollFailures++
+	return *maxPollFailures > 0 && c.consecutivePollFailures >= *maxPollFailures
+}
+
+// recordScrapeResult updates the number of failed scrapes in a row of
+// target, resetting it if the target responded.
+func (c *Coordinator) recordScrapeResult(target string, responded bool) {
+	label := c.targetLabels.label(target)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scrapeFailureStreaks == nil {
+		c.scrapeFailureStreaks = map[string]int{}
+	}
+	if responded {
+		c.scrapeFailureStreaks[label] = 0
+	} else {
+		c.scrapeFailureStreaks[label]++
+	}
+	scrapeConsecutiveFailuresGauge.WithLabelValues(label).Set(float64(c.scrapeFailureStreaks[label]))
+}
+
+// setPaused pauses or resumes scraping. Polling continues while paused.
+func (c *Coordinator) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+	if paused {
+		pausedGauge.Set(1)
+	} else {
+		pausedGauge.Set(0)
+	}
+}
+
+func (c *Coordinator) isPaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// setPollBackoff records the time to wait before the next poll.
+func (c *Coordinator) setPollBackoff(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pollBackoff = d
+	pollBackoffGauge.Set(d.Seconds())
+}
+
+// pollError returns the error of the last poll, if it failed, or
+// errNotPolledYet until a poll succeeded.
+func (c *Coordinator) pollError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastPollError == nil && c.lastSuccessfulPoll.IsZero() {
+		return errNotPolledYet
+	}
+	return c.lastPollError
+}
+
+func (c *Coordinator) markPollAttempt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPollAttempt = time.Now()
+}
+
+func (c *Coordinator) setConfig(cfg *reloadableConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = cfg
+	if c.pushGate != nil {
+		c.pushGate.setWaits(time.Duration(cfg.PushRetry.InitialWait), time.Duration(cfg.PushRetry.MaxWait))
+	}
+}
+
+// getConfig returns the reloadable configuration, which must not be
+// modified.
+func (c *Coordinator) getConfig() *reloadableConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config == nil {
+		return configFromFlags()
+	}
+	return c.config
+}
+
+func (c *Coordinator) setRegistrationCert(cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registrationCert = cert
+}
+
+func (c *Coordinator) getRegistrationCert() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registrationCert
+}
+
+// setCancelPollWait sets the function cutting short the wait before the
+// next poll.
+func (c *Coordinator) setCancelPollWait(cancel context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelPollWait = cancel
+}
+
+// repoll makes the poll loop poll again right away if it's waiting to retry
+// a failed poll.
+func (c *Coordinator) repoll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelPollWait != nil {
+		c.cancelPollWait()
+	}
+}
+
+// waitPollInterval sleeps until at least interval has passed since the last
+// poll was started.
+func (c *Coordinator) waitPollInterval(interval time.Duration) {
+	c.mu.Lock()
+	wait := time.Until(c.lastPollAttempt.Add(interval))
+	c.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// pollStalled reports whether no poll has been attempted within timeout.
+func (c *Coordinator) pollStalled(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Polling is paused on purpose while draining.
+	if c.draining {
+		return false
+	}
+	return time.Since(c.lastPollAttempt) > timeout
+}
+
+// watchdog exits the process once polling has stalled for longer than
+// timeout, so that the client gets restarted by its supervisor.
+func (c *Coordinator) watchdog(timeout time.Duration) {
+	c.markPollAttempt()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.pollStalled(timeout) {
+			level.Error(c.logger).Log("msg", "No poll attempted within the watchdog timeout, exiting", "timeout", timeout)
+			os.Exit(1)
+		}
+	}
+}
+
+// validateWatchdogTimeout checks that the watchdog can't fire while the poll
+// loop deliberately waits before polling again. The watchdog is paused
+// during reloads, but a poll may still have to wait for one to drain.
+func validateWatchdogTimeout(timeout time.Duration, cfg *reloadableConfig) error {
+	if timeout <= 0 {
+		return nil
+	}
+	for _, wait := range []struct {
+		flag     string
+		duration time.Duration
+	}{
+		{"--proxy.retry.max-wait", time.Duration(cfg.ProxyRetry.MaxWait)},
+		{"--proxy.retry.protocol-error-wait", *retryProtocolErrorWait},
+		{"--poll.min-interval", *pollMinInterval},
+		{"--reload.drain-timeout", *reloadDrainTimeout},
+	} {
+		if timeout <= wait.duration {
+			return fmt.Errorf("--watchdog.timeout %s must be larger than %s %s", timeout, wait.flag, wait.duration)
+		}
+	}
+	return nil
+}
+
+// heartbeat logs the state of the client every interval, so that quiet
+// clients can be seen to be alive in their logs.
+func (c *Coordinator) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.logHeartbeat()
+	}
+}
+
+// logHeartbeat logs the state of the client and resets the number of
+// scrapes since the last heartbeat.
+func (c *Coordinator) logHeartbeat() {
+	c.mu.Lock()
+	lastSuccessfulPoll, pollErr := c.lastSuccessfulPoll, c.lastPollError
+	scrapes, pollBackoff := c.scrapesSinceHeartbeat, c.pollBackoff
+	c.scrapesSinceHeartbeat = 0
+	c.mu.Unlock()
+
+	lastPoll := "never"
+	if !lastSuccessfulPoll.IsZero() {
+		lastPoll = lastSuccessfulPoll.Format(time.RFC3339)
+	}
+	level.Info(c.logger).Log("msg", "Heartbeat", "last_successful_poll", lastPoll, "poll_ok", pollErr == nil, "scrapes", scrapes, "poll_backoff", pollBackoff)
+}
+
+// setCapabilities records the capabilities advertised by the proxy, logging
+// them and updating the features they enable whenever they change.
+func (c *Coordinator) setCapabilities(caps util.Capabilities) {
+	c.mu.Lock()
+	changed := c.capabilities == nil || c.capabilities.String() != caps.String()
+	if changed {
+		c.capabilities = caps
+	}
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	level.Info(c.logger).Log("msg", "Negotiated proxy capabilities", "capabilities", caps.String())
+	observeFeatures(c.enabledFeatures())
+}
+
+// proxySupports reports whether the proxy advertised the named capability.
+func (c *Coordinator) proxySupports(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities.Has(name)
+}
+
+// compressPushes reports whether pushes are compressed, see
+// --push.compression.
+func (c *Coordinator) compressPushes() bool {
+	switch *pushCompression {
+	case "gzip":
+		return true
+	case "auto":
+		return c.proxySupports(util.PushGzipCapability)
+	}
+	return false
+}
+
+// clientRequestIDHeader carries the id the client generated for a scrape, on
+// both the scrape request and the push, with --push.add-client-request-id.
+const clientRequestIDHeader = "X-PushProx-Client-Request-Id"
+
+// errorTypeHeader carries the category of a failed scrape on error pushes.
+const errorTypeHeader = "X-PushProx-Error-Type"
+
+var (
+	errFqdnMismatch   = errors.New("scrape target doesn't match proxy client fqdn")
+	errScrapeLoop     = errors.New("scrape target is the client's own metrics endpoint")
+	errPortNotAllowed = errors.New("port is not allowed by --local-scrape.allowed-ports")
+	errPaused         = errors.New("paused")
+	errNotPolledYet   = errors.New("no successful poll of the proxy yet")
+	errTruncated      = errors.New("truncated response")
+
+	errorTypes = []string{"timeout", "dns", "refused", "tls", "fqdn-mismatch", "scrape-loop", "port-not-allowed", "paused", "truncated", "other"}
+)
+
+// portAllowed reports whether port is in allowed, or allowed is empty.
+func portAllowed(port string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, p := range allowed {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// alwaysForwardedHeaders are forwarded to scrape targets even when only some
+// headers are to be forwarded.
+var alwaysForwardedHeaders = []string{"Accept", "X-Prometheus-Scrape-Timeout-Seconds", clientRequestIDHeader}
+
+// filterHeaders returns the headers of h named in allowed or in
+// alwaysForwardedHeaders.
+func filterHeaders(h http.Header, allowed []string) http.Header {
+	filtered := http.Header{}
+	for _, names := range [][]string{alwaysForwardedHeaders, allowed} {
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			if values, ok := h[name]; ok {
+				filtered[name] = values
+			}
+		}
+	}
+	return filtered
+}
+
+// limitHeaders returns at most max headers of h, always keeping
+// alwaysForwardedHeaders first and then the others in the order of their
+// names, and the number of headers dropped.
+func limitHeaders(h http.Header, max int) (http.Header, int) {
+	if len(h) <= max {
+		return h, 0
+	}
+	limited := http.Header{}
+	for _, name := range alwaysForwardedHeaders {
+		if values, ok := h[name]; ok && len(limited) < max {
+			limited[name] = values
+		}
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(limited) >= max {
+			break
+		}
+		if _, ok := limited[name]; !ok {
+			limited[name] = h[name]
+		}
+	}
+	return limited, len(h) - len(limited)
+}
+
+// randomDelay returns a random duration in [0, max). It uses its own seeded
+// source, so that clients started together don't all pick the same delay.
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(max)))
+}
+
+// statusClass returns the class of an HTTP status code, e.g. "2xx".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// errorType returns a coarse category for a scrape error.
+func errorType(err error) string {
+	var (
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+	)
+	switch {
+	case errors.Is(err, errFqdnMismatch):
+		return "fqdn-mismatch"
+	case errors.Is(err, errScrapeLoop):
+		return "scrape-loop"
+	case errors.Is(err, errPortNotAllowed):
+		return "port-not-allowed"
+	case errors.Is(err, errPaused):
+		return "paused"
+	case errors.Is(err, errTruncated):
+		return "truncated"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr), errors.As(err, &hostnameErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// errorStatus returns the status code to push for a failed scrape of type
+// errType. With gatewayStatus, failures to reach the target are reported
+// like a gateway would instead of as 500.
+func errorStatus(errType string, gatewayStatus bool) int {
+	switch errType {
+	case "port-not-allowed":
+		return http.StatusForbidden
+	case "paused":
+		return http.StatusServiceUnavailable
+	case "truncated":
+		return http.StatusBadGateway
+	}
+	if gatewayStatus {
+		switch errType {
+		case "timeout":
+			return http.StatusGatewayTimeout
+		case "dns", "refused", "tls":
+			return http.StatusBadGateway
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// scrapeError is the body of error pushes with --push.error-format=json.
+type scrapeError struct {
+	Error    string `json:"error"`
+	Type     string `json:"type"`
+	ScrapeID string `json:"scrape_id"`
+	FQDN     string `json:"fqdn"`
 }
 
 func (c *Coordinator) handleErr(request *http.Request, proxyClient *http.Client, err error) {
 	level.Error(c.logger).Log("err", err)
-	scrapeErrorCounter.Inc()
+	errType := errorType(err)
+	scrapeErrorCounter.WithLabelValues(errType).Inc()
+	c.recordScrapeResult(request.URL.Host, false)
+	statusCode := errorStatus(errType, *pushGatewayStatus)
+	body, contentType := []byte(err.Error()), "text/plain; charset=utf-8"
+	if *pushErrorFormat == "json" {
+		jsonBody, jsonErr := json.Marshal(scrapeError{
+			Error:    err.Error(),
+			Type:     errType,
+			ScrapeID: request.Header.Get("id"),
+			FQDN:     *myFqdn,
+		})
+		if jsonErr == nil {
+			body, contentType = jsonBody, "application/json"
+		}
+	}
 	resp := &http.Response{
-		StatusCode: http.StatusInternalServerError,
-		Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
-		Header:     http.Header{},
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
 	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set(errorTypeHeader, errType)
 	if err = c.doPush(resp, request, proxyClient); err != nil {
 		pushErrorCounter.Inc()
 		level.Warn(c.logger).Log("msg", "Failed to push failed scrape response:", "err", err)
@@ -113,14 +1167,24 @@ func (c *Coordinator) handleErr(request *http.Request, proxyClient *http.Client,
 }
 
 func (c *Coordinator) doScrape(request *http.Request, proxyClient *http.Client, scrapeTargetClient *http.Client) {
+	c.addScrapesInFlight(1)
+	defer c.addScrapesInFlight(-1)
+	if *addClientRequestID {
+		request.Header.Set(clientRequestIDHeader, uuid.New().String())
+	}
 	logger := log.With(c.logger, "scrape_id", request.Header.Get("id"))
+	if id := request.Header.Get(clientRequestIDHeader); id != "" {
+		logger = log.With(logger, "client_request_id", id)
+	}
+	defer c.inFlight.start(request.Header.Get("id"), request.URL.Host, time.Now())()
 	timeout, err := util.GetHeaderTimeout(request.Header)
 	if err != nil {
-		c.handleErr(request, proxyClient, err) // CHECK WHICH CLIENT
+		c.handleErr(request, proxyClient, err)
 		return
 	}
 	ctx, cancel := context.WithTimeout(request.Context(), timeout)
 	defer cancel()
+	ctx = withScrapeDeadline(ctx)
 	request = request.WithContext(ctx)
 	// We cannot handle https requests at the proxy, as we would only
 	// see a CONNECT, so use a URL parameter to trigger it.
@@ -131,115 +1195,429 @@ func (c *Coordinator) doScrape(request *http.Request, proxyClient *http.Client,
 		request.URL.RawQuery = params.Encode()
 	}
 
+	if c.isPaused() {
+		c.handleErr(request, proxyClient, errPaused)
+		return
+	}
 	if request.URL.Hostname() != *myFqdn {
-		c.handleErr(request, proxyClient, errors.New("scrape target doesn't match proxy client fqdn"))
+		c.handleErr(request, proxyClient, errFqdnMismatch)
 		return
 	}
 
+	// The target may be rewritten below, keep the original request for
+	// pushing the response.
+	scrapeRequest := request.Clone(ctx)
 	// For scraping multiple clients locally. Use "localScrape" to indicate use of localhost and differentiate between clients.
-	originalHost := request.URL.Host
 	if *localScrape != "" {
-		portNumber := strings.Split(request.URL.Host, ":")[1]  
-		request.URL.Host = "localhost:" + portNumber
+		portNumber := scrapeRequest.URL.Port()
+		if !portAllowed(portNumber, *localScrapeAllowedPorts) {
+			c.handleErr(request, proxyClient, errors.Wrapf(errPortNotAllowed, "refusing to scrape local port %q", portNumber))
+			return
+		}
+		if portNumber == "" {
+			localScrapeRewritesSkippedCounter.Inc()
+			level.Warn(logger).Log("msg", "Scrape target has no port, not rewriting it to localhost", "url", scrapeRequest.URL)
+		} else {
+			scrapeRequest.URL.Host = net.JoinHostPort("localhost", portNumber)
+			localScrapeRewritesCounter.Inc()
+		}
+	}
+	if c.urlRewrite != nil {
+		if scrapeRequest.URL, err = c.urlRewrite.apply(scrapeRequest.URL); err != nil {
+			c.handleErr(request, proxyClient, err)
+			return
+		}
+	}
+	if *scrapeHostHeader != "" {
+		scrapeRequest.Host = *scrapeHostHeader
+	}
+	if *scrapeDisableExpectContinue {
+		scrapeRequest.Header.Del("Expect")
+	}
+	if len(*scrapeForwardHeaders) > 0 {
+		scrapeRequest.Header = filterHeaders(scrapeRequest.Header, *scrapeForwardHeaders)
+	}
+	if *scrapeMaxForwardHeaders > 0 {
+		var dropped int
+		if scrapeRequest.Header, dropped = limitHeaders(scrapeRequest.Header, *scrapeMaxForwardHeaders); dropped > 0 {
+			level.Warn(logger).Log("msg", "Dropped headers of scrape request, see --scrape.max-forward-headers", "dropped", dropped)
+		}
+	}
+	if c.scrapeToken != nil {
+		token, err := c.scrapeToken.get()
+		if err != nil {
+			c.handleErr(request, proxyClient, err)
+			return
+		}
+		scrapeRequest.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.preScrapeToken != nil {
+		token, err := c.preScrapeToken.get(ctx)
+		if err != nil {
+			c.handleErr(request, proxyClient, err)
+			return
+		}
+		scrapeRequest.Header.Set(*preScrapeCommandHeader, token)
+	}
+	// The encoding of the scrape is independent of the one of the push, see
+	// --push.compression. Without an explicit Accept-Encoding, the transport
+	// asks for gzip and decompresses transparently.
+	scrapeRequest.Header.Del("Accept-Encoding")
+	if !*scrapeAcceptGzip {
+		scrapeRequest.Header.Set("Accept-Encoding", "identity")
+	}
+	// See --self-metrics-path.
+	if isMappedSelfScrape(request.URL, scrapeRequest.URL, *metricsAddr) {
+		c.handleErr(request, proxyClient, errors.Wrapf(errScrapeLoop, "refusing to scrape %s", scrapeRequest.URL))
+		return
 	}
 
-	scrapeResp, err := scrapeTargetClient.Do(request)
+	scrapeStart := time.Now()
+	scrapeResp, err := scrapeTargetClient.Do(scrapeRequest)
 	if err != nil {
-		msg := fmt.Sprintf("failed to scrape %s", request.URL.String())
-		c.handleErr(request, scrapeTargetClient, errors.Wrap(err, msg))
+		msg := fmt.Sprintf("failed to scrape %s", scrapeRequest.URL.String())
+		// The transport doesn't export an error type for this.
+		switch {
+		case strings.Contains(err.Error(), "server response headers exceeded"):
+			scrapeHeadersTooLargeCounter.Inc()
+			msg = fmt.Sprintf("response headers of %s are too large, see --scrape.max-header-bytes", scrapeRequest.URL.String())
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+			// The target is slow rather than failing.
+			scrapeTimeoutsCounter.WithLabelValues(c.targetLabels.label(request.URL.Host)).Inc()
+			msg = fmt.Sprintf("scrape of %s timed out after %s", scrapeRequest.URL.String(), timeout)
+		}
+		c.handleErr(request, proxyClient, errors.Wrap(err, msg))
 		return
 	}
-	level.Info(logger).Log("msg", "Retrieved scrape response")
-
-	if *localScrape != "" {
-		request.URL.Host = originalHost
+	scrapeResponseStatusCounter.WithLabelValues(statusClass(scrapeResp.StatusCode)).Inc()
+	// Read the whole body, so that the pushed response can't have a
+	// Content-Length that disagrees with its body.
+	body, err := ioutil.ReadAll(scrapeResp.Body)
+	scrapeResp.Body.Close()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// The target closed the connection before sending the whole body,
+		// don't push a partial response.
+		c.handleErr(request, proxyClient, errors.Wrapf(errTruncated, "scrape response from %s ended early", scrapeRequest.URL.String()))
+		return
 	}
+	if err != nil {
+		msg := fmt.Sprintf("failed to read scrape response from %s", scrapeRequest.URL.String())
+		c.handleErr(request, proxyClient, errors.Wrap(err, msg))
+		return
+	}
+	scrapeDuration := time.Since(scrapeStart)
+	// Only successful responses go through --scrape.transform and get the
+	// labels of --config.file.
+	transformers := []BodyTransformer{decompressTransformer{}}
+	if scrapeResp.StatusCode/100 == 2 {
+		transformers = append(transformers, c.bodyTransformers...)
+		if t := c.getConfig().labelTransformer(c.logger); t != nil {
+			transformers = append(transformers, t)
+		}
+	}
+	if body, err = transformBody(transformers, scrapeResp.Header, body); err != nil {
+		msg := fmt.Sprintf("failed to transform scrape response from %s", scrapeRequest.URL.String())
+		c.handleErr(request, proxyClient, errors.Wrap(err, msg))
+		return
+	}
+	scrapeResp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	scrapeResp.ContentLength = int64(len(body))
+	if *pushMetadataHeaders {
+		scrapeResp.Header.Set("X-PushProx-Scrape-Duration-Seconds", fmt.Sprintf("%f", scrapeDuration.Seconds()))
+		scrapeResp.Header.Set("X-PushProx-Scrape-Bytes", strconv.Itoa(len(body)))
+	}
+	if *scrapeWarnBodyBytes > 0 && len(body) > *scrapeWarnBodyBytes {
+		level.Warn(logger).Log("msg", "Scrape response is larger than expected", "target", scrapeRequest.URL.Host, "bytes", len(body), "threshold", *scrapeWarnBodyBytes)
+		largeScrapeCounter.WithLabelValues(c.targetLabels.label(request.URL.Host)).Inc()
+	}
+	level.Info(logger).Log("msg", "Retrieved scrape response")
 
 	if err = c.doPush(scrapeResp, request, proxyClient); err != nil {
 		pushErrorCounter.Inc()
 		level.Warn(logger).Log("msg", "Failed to push scrape response:", "err", err)
 		return
 	}
+	// Only a response that was read and pushed in full ends a streak of
+	// failures.
+	c.recordScrapeResult(request.URL.Host, true)
+	lastSuccessfulPushGauge.WithLabelValues(c.targetLabels.label(request.URL.Host)).SetToCurrentTime()
 	level.Info(logger).Log("msg", "Pushed scrape result")
 }
 
 // Report the result of the scrape back up to the proxy.
 func (c *Coordinator) doPush(resp *http.Response, origRequest *http.Request, proxyClient *http.Client) error {
 	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
+	if id := origRequest.Header.Get(clientRequestIDHeader); id != "" {
+		resp.Header.Set(clientRequestIDHeader, id)
+	}
 	// Remaining scrape deadline.
 	deadline, _ := origRequest.Context().Deadline()
 	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
+	if c.compressPushes() && acceptsGzip(origRequest.Header) && resp.Header.Get("Content-Encoding") == "" {
+		if err := gzipResponse(resp); err != nil {
+			return errors.Wrap(err, "failed to compress scrape response")
+		}
+	}
 
-	base, err := url.Parse(*proxyURL)
-	if err != nil {
+	buf := &bytes.Buffer{}
+	if err := resp.Write(buf); err != nil {
+		return errors.Wrap(err, "failed to serialize scrape response")
+	}
+	body := buf.Bytes()
+	if c.pushDumper != nil {
+		if err := c.pushDumper.dump(origRequest.Header.Get("id"), body, time.Now()); err != nil {
+			level.Warn(c.logger).Log("msg", "Failed to dump push", "err", err)
+		}
+	}
+
+	bo, retryAfter := newPushBackOff(origRequest.Context(), c.getConfig().PushRetry)
+	op := func() error {
+		if err := c.pushGate.wait(origRequest.Context()); err != nil {
+			return backoff.Permanent(err)
+		}
+		err := c.sendPush(origRequest.Context(), proxyClient, body)
+		c.pushGate.record(err, time.Now())
+		retryAfter.observe(err)
+		if errors.Is(err, errUnknownScrape) || errors.Is(err, errExpiredScrape) {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
-	u, err := url.Parse("push")
-	if err != nil {
+	err := backoff.RetryNotify(op, bo, func(err error, next time.Duration) {
+		level.Warn(c.logger).Log("msg", "Failed to push, retrying", "scrape_id", origRequest.Header.Get("id"), "err", err, "retry_in", next)
+	})
+	if errors.Is(err, errUnknownScrape) {
+		// The proxy has most likely restarted and lost the poll that got
+		// us the scrape, register again without waiting for the backoff.
+		level.Warn(c.logger).Log("msg", "Proxy doesn't know the pushed scrape, polling again", "scrape_id", origRequest.Header.Get("id"))
+		repollsCounter.Inc()
+		c.repoll()
 		return err
 	}
-	url := base.ResolveReference(u)
+	if errors.Is(err, errExpiredScrape) {
+		// Prometheus has given up on the scrape, there's nothing to do.
+		level.Info(c.logger).Log("msg", "Proxy is no longer waiting for the pushed scrape", "scrape_id", origRequest.Header.Get("id"))
+		return err
+	}
+	if c.pushBuffer != nil {
+		if err != nil {
+			deadline, _ := origRequest.Context().Deadline()
+			c.pushBuffer.add(origRequest.Header.Get("id"), body, deadline)
+			level.Info(c.logger).Log("msg", "Buffered failed push", "scrape_id", origRequest.Header.Get("id"))
+		} else {
+			go c.flushPushBuffer(proxyClient)
+		}
+	}
+	return err
+}
 
-	buf := &bytes.Buffer{}
-	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
-	resp.Write(buf)
+// sendPush makes a single attempt at pushing a serialized scrape response.
+func (c *Coordinator) sendPush(ctx context.Context, proxyClient *http.Client, body []byte) error {
+	url, err := c.pushEndpoint(ctx)
+	if err != nil {
+		return err
+	}
 	request := &http.Request{
 		Method:        "POST",
 		URL:           url,
-		Body:          ioutil.NopCloser(buf),
-		ContentLength: int64(buf.Len()),
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		// Sends Connection: close.
+		Close: *pushConnectionClose,
+	}
+	// The body is a serialized HTTP response.
+	request.Header.Set("Content-Type", "message/http")
+	setHeaders(request.Header, c.pushHeaders)
+	request = request.WithContext(ctx)
+	if err := c.authenticate(request); err != nil {
+		return err
+	}
+	pushResp, err := proxyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer pushResp.Body.Close()
+	io.Copy(ioutil.Discard, pushResp.Body)
+	if err := checkOverload(pushResp, time.Now()); err != nil {
+		return err
 	}
-	request = request.WithContext(origRequest.Context())
-	if _, err = proxyClient.Do(request); err != nil {
+	if err := checkUnknownScrape(pushResp); err != nil {
 		return err
 	}
+	if pushResp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status from proxy: %s", pushResp.Status)
+	}
 	return nil
 }
 
+// flushPushBuffer pushes the buffered responses, stopping at the first
+// failure. Only one flush runs at a time.
+func (c *Coordinator) flushPushBuffer(proxyClient *http.Client) {
+	pushes := c.pushBuffer.startFlush()
+	if len(pushes) == 0 {
+		return
+	}
+	for i, p := range pushes {
+		ctx, cancel := context.WithDeadline(context.Background(), p.expires)
+		err := c.sendPush(ctx, proxyClient, p.body)
+		cancel()
+		if errors.Is(err, errUnknownScrape) || errors.Is(err, errExpiredScrape) {
+			// Pushing it again won't help.
+			level.Warn(c.logger).Log("msg", "Dropping buffered response the proxy doesn't wait for", "scrape_id", p.id, "err", err)
+			continue
+		}
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Failed to push buffered response", "scrape_id", p.id, "err", err)
+			c.pushBuffer.endFlush(pushes[i:])
+			return
+		}
+		level.Info(c.logger).Log("msg", "Pushed buffered response", "scrape_id", p.id)
+	}
+	c.pushBuffer.endFlush(nil)
+}
+
 func (c *Coordinator) doPoll(proxyClient *http.Client, scrapeTargetClient *http.Client) error {
-	base, err := url.Parse(*proxyURL)
+	c.markPollAttempt()
+	proxyURL := c.getProxyURL()
+	url, err := resolveEndpoint(proxyURL, *pollPath)
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
 		return errors.Wrap(err, "error parsing url")
 	}
-	u, err := url.Parse("poll")
+	pollRequest, err := http.NewRequest("POST", url.String(), strings.NewReader(*myFqdn))
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
-		return errors.Wrap(err, "error parsing url poll")
+		return errors.Wrap(err, "error creating poll request")
+	}
+	pollRequest.Header.Set("Content-Type", *pollContentType)
+	// Setting this explicitly stops the transport from decompressing, so
+	// that it's done the same way whatever transport is in use.
+	pollRequest.Header.Set("Accept-Encoding", "gzip")
+	setHeaders(pollRequest.Header, c.pollHeaders)
+	if cert := c.getRegistrationCert(); cert != nil {
+		if err := util.SignRegistration(pollRequest.Header, cert, *myFqdn, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := c.authenticate(pollRequest); err != nil {
+		return err
+	}
+	if *tracePollTimings {
+		pollRequest = pollRequest.WithContext(httptrace.WithClientTrace(pollRequest.Context(), newPollTrace()))
 	}
-	url := base.ResolveReference(u)
-	resp, err := proxyClient.Post(url.String(), "", strings.NewReader(*myFqdn))
+	pollStart := time.Now()
+	// Errors are logged by the poll loop, see --log.poll-error-sample.
+	resp, err := proxyClient.Do(pollRequest)
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error polling:", "err", err)
 		return errors.Wrap(err, "error polling")
 	}
 	defer resp.Body.Close()
+	if err := checkOverload(resp, time.Now()); err != nil {
+		return err
+	}
+	if err := checkRejected(resp); err != nil {
+		return err
+	}
 
-	request, err := http.ReadRequest(bufio.NewReader(resp.Body))
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrap(err, "error decompressing poll response")
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if *maxPollResponseBytes > 0 {
+		// Don't let a misbehaving proxy make us buffer arbitrary amounts,
+		// also when decompressed.
+		limited, err := ioutil.ReadAll(io.LimitReader(body, *maxPollResponseBytes+1))
+		if err != nil {
+			return errors.Wrap(err, "error reading poll response")
+		}
+		if int64(len(limited)) > *maxPollResponseBytes {
+			return fmt.Errorf("poll response exceeds %d bytes", *maxPollResponseBytes)
+		}
+		body = bytes.NewReader(limited)
+	}
+
+	counted := &countingReader{r: body}
+	parseStart := time.Now()
+	request, err := http.ReadRequest(bufio.NewReader(counted))
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error reading request:", "err", err)
 		return errors.Wrap(err, "error reading request")
 	}
+	pollParseDurationHistogram.Observe(time.Since(parseStart).Seconds())
+	pollRTTHistogram.Observe(time.Since(pollStart).Seconds())
+	pollResponseBytesHistogram.Observe(float64(counted.n))
+	c.setCapabilities(util.ParseCapabilities(resp.Header))
+	c.scrapeIDs.observeScrapeRequest(request.Header.Get("id"))
 	level.Info(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL)
 
 	request.RequestURI = ""
+	request = request.WithContext(context.WithValue(request.Context(), pollSourceKey{}, proxyURL))
 
 	go c.doScrape(request, proxyClient, scrapeTargetClient)
 
 	return nil
 }
 
-func (c *Coordinator) loop(bo backoff.BackOff, proxyClient *http.Client, scrapeTargetClient *http.Client) {
+func (c *Coordinator) loop(bo *backoff.ExponentialBackOff, proxyClient *http.Client, scrapeTargetClient *http.Client) {
+	// Spread the polls of clients started at the same time, e.g. by a
+	// deployment.
+	time.Sleep(randomDelay(*pollStartupJitter))
+	retryAfter := &retryAfterBackOff{BackOff: bo, protocolWait: *retryProtocolErrorWait}
+	floor := &pollFloor{}
+	// Applies the waits of the current configuration, which may have been
+	// reloaded.
+	setWaits := func() {
+		retry := c.getConfig().ProxyRetry
+		bo.InitialInterval, bo.MaxInterval = time.Duration(retry.InitialWait), time.Duration(retry.MaxWait)
+		retryAfter.max = bo.MaxInterval
+		floor.step, floor.max = bo.InitialInterval, bo.MaxInterval
+	}
+	setWaits()
+	c.setPollBackoff(bo.InitialInterval)
+	errorLog := &logSampler{n: *pollErrorLogSample, interval: time.Minute}
+	minInterval := *pollMinInterval
 	op := func() error {
-		return c.doPoll(proxyClient, scrapeTargetClient)
+		// Wait for any drain to complete.
+		c.pollGate.RLock()
+		c.pollGate.RUnlock()
+		setWaits()
+		c.waitPollInterval(minInterval)
+		err := c.doPoll(proxyClient, scrapeTargetClient)
+		c.recordPollResult(err)
+		retryAfter.observe(err)
+		if *pollAdaptiveFloor {
+			minInterval = *pollMinInterval
+			if f := floor.observe(err); f > minInterval {
+				minInterval = f
+			}
+		}
+		if err == nil {
+			c.notifyPollSuccess(errorLog)
+		}
+		if c.tooManyPollFailures(err) {
+			level.Error(c.logger).Log("msg", "Polling failed too many times in a row, exiting", "failures", c.consecutivePollFailures, "err", err)
+			os.Exit(1)
+		}
+		if err == nil {
+			c.countPollForReconnect(proxyClient)
+		}
+		return err
 	}
 
 	for {
-		if err := backoff.RetryNotify(op, bo, func(err error, _ time.Duration) {
-			pollErrorCounter.Inc()
-		}); err != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.setCancelPollWait(cancel)
+		err := backoff.RetryNotify(op, backoff.WithContext(retryAfter, ctx), func(err error, next time.Duration) {
+			c.notifyPollError(errorLog, err, next, time.Now())
+		})
+		// A canceled wait is retried right away.
+		if err != nil && ctx.Err() == nil {
 			level.Error(c.logger).Log("err", err)
 		}
+		cancel()
 	}
 }
 
@@ -247,135 +1625,342 @@ func main() {
 	promlogConfig := promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, &promlogConfig)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(&promlogConfig)
-	coordinator := Coordinator{logger: logger}
+	if command == checkConfigCommand.FullCommand() {
+		os.Exit(runCheckConfig(logger))
+	}
+	coordinator := &Coordinator{logger: logger}
 
+	if err := expandPathFlags(coordinator.logger); err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid file path", "err", err)
+		os.Exit(exitConfig)
+	}
+	if err := resolveFQDN(coordinator.logger, fqdn.Get); err != nil {
+		level.Error(coordinator.logger).Log("msg", "Failed to determine FQDN", "err", err)
+		os.Exit(exitConfig)
+	}
+	if *proxyURLFile != "" {
+		if *proxyURL != "" {
+			level.Error(coordinator.logger).Log("msg", "--proxy-url and --proxy-url-file are mutually exclusive.")
+			os.Exit(exitConfig)
+		}
+		u, err := readProxyURLFile(*proxyURLFile)
+		if err != nil {
+			level.Error(coordinator.logger).Log("msg", "Failed to read proxy url file", "err", err)
+			os.Exit(exitConfig)
+		}
+		*proxyURL = u
+	}
 	if *proxyURL == "" {
-		level.Error(coordinator.logger).Log("msg", "--proxy-url flag must be specified.")
-		os.Exit(1)
+		level.Error(coordinator.logger).Log("msg", "--proxy-url or --proxy-url-file flag must be specified.")
+		os.Exit(exitConfig)
 	}
-	// Make sure proxyURL ends with a single '/'
-	*proxyURL = strings.TrimRight(*proxyURL, "/") + "/"
-	level.Info(coordinator.logger).Log("msg", "URL and FQDN info", "proxy_url", *proxyURL, "fqdn", *myFqdn)
-
-	tlsConfig := &tls.Config{}
-	if *tlsCert != "" {
-		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	for _, p := range []string{*pollPath, *pushPath} {
+		if err := validateEndpointPath(p); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Invalid proxy endpoint path", "err", err)
+			os.Exit(exitConfig)
+		}
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid configuration", "err", err)
+		os.Exit(exitConfig)
+	}
+	coordinator.setConfig(config)
+	if *scrapeURLRewrite != "" {
+		rewrite, err := parseURLRewrite(*scrapeURLRewrite)
 		if err != nil {
-			level.Error(coordinator.logger).Log("msg", "Certificate or Key is invalid", "err", err)
-			os.Exit(1)
+			level.Error(coordinator.logger).Log("msg", "Invalid --scrape.url-rewrite", "err", err)
+			os.Exit(exitConfig)
+		}
+		coordinator.urlRewrite = rewrite
+	}
+	if *pushBufferSize > 0 {
+		coordinator.pushBuffer = newPushBuffer(*pushBufferSize, *pushBufferTTL)
+	}
+	for _, port := range *localScrapeAllowedPorts {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			level.Error(coordinator.logger).Log("msg", "Invalid --local-scrape.allowed-ports", "port", port)
+			os.Exit(exitConfig)
+		}
+	}
+	if *scrapeAddFQDNLabel != "" {
+		if err := validateLabelName(*scrapeAddFQDNLabel); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Invalid --scrape.add-fqdn-label", "err", err)
+			os.Exit(exitConfig)
+		}
+	}
+	bodyTransformers, err := newBodyTransformers(coordinator.logger, scrapeTransformerNames())
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid --scrape.transform", "err", err)
+		os.Exit(exitConfig)
+	}
+	coordinator.bodyTransformers = bodyTransformers
+	if *preScrapeCommand != "" {
+		coordinator.preScrapeToken = &commandToken{command: *preScrapeCommand, ttl: *preScrapeCommandTTL, now: time.Now}
+	}
+	if *scrapeBearerTokenFile != "" {
+		coordinator.scrapeToken = &tokenFile{file: *scrapeBearerTokenFile, ttl: time.Minute, now: time.Now}
+		if _, err := coordinator.scrapeToken.get(); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Failed to read --scrape.bearer-token-file", "err", err)
+			os.Exit(exitConfig)
+		}
+	}
+	coordinator.targetLabels = &targetLabeler{max: *metricsMaxTargets}
+	if *pushSharedBackoff {
+		coordinator.pushGate = &pushGate{initial: time.Duration(config.PushRetry.InitialWait), max: time.Duration(config.PushRetry.MaxWait)}
+	}
+	if *dumpPushesDir != "" {
+		if err := os.MkdirAll(*dumpPushesDir, 0700); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Failed to create push dump directory", "err", err)
+			os.Exit(exitConfig)
 		}
+		level.Warn(coordinator.logger).Log("msg", "Dumping pushes to disk", "dir", *dumpPushesDir)
+		coordinator.pushDumper = &pushDumper{dir: *dumpPushesDir, maxBytes: *dumpPushesMaxBytes, maxFiles: *dumpPushesMaxFiles}
+	}
+	coordinator.setProxyURL(*proxyURL)
+	level.Info(coordinator.logger).Log("msg", "URL and FQDN info", "proxy_url", coordinator.getProxyURL(), "fqdn", *myFqdn)
 
-		// Setup HTTPS client
-		tlsConfig.Certificates = []tls.Certificate{cert}
+	proxyHeaders, err := parseStaticHeaders(*proxyHeaderFlags)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid --proxy.header", "err", err)
+		os.Exit(exitConfig)
+	}
+	pushOnlyHeaders, err := parseStaticHeaders(*pushHeaderFlags)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid --push.header", "err", err)
+		os.Exit(exitConfig)
+	}
+	// --push.header takes precedence for pushes.
+	pushHeaders := proxyHeaders.Clone()
+	setHeaders(pushHeaders, pushOnlyHeaders)
+	coordinator.pollHeaders, coordinator.pushHeaders = proxyHeaders, pushHeaders
 
-		tlsConfig.BuildNameToCertificate()
+	authenticator, err := newProxyAuthenticator(*proxyAuthType, *proxyAuthUsername, *proxyAuthCredentialsFile)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Failed to set up proxy authentication", "err", err)
+		os.Exit(exitConfig)
 	}
+	coordinator.authenticator = authenticator
 
-	if *caCertFile != "" {
-		caCert, err := ioutil.ReadFile(*caCertFile)
-		if err != nil {
-			level.Error(coordinator.logger).Log("msg", "Not able to read cacert file", "err", err)
-			os.Exit(1)
-		}
-		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-			level.Error(coordinator.logger).Log("msg", "Failed to use cacert file as ca certificate")
-			os.Exit(1)
+	if _, err := newTLSConfig(); err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid TLS flags", "err", err)
+		os.Exit(exitConfig)
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Failed to load TLS configuration", "err", err)
+		os.Exit(exitTLS)
+	}
+	if *tlsCert != "" {
+		registry.MustRegister(tlsCertNotAfterGauge, tlsCertNotBeforeGauge)
+		observeCertificate(tlsConfig)
+	}
+	if *proxySignRegistration {
+		if *tlsCert == "" {
+			level.Error(coordinator.logger).Log("msg", "--proxy.sign-registration requires --tls.cert and --tls.key")
+			os.Exit(exitConfig)
 		}
+		coordinator.setRegistrationCert(&tlsConfig.Certificates[0])
+	}
 
-		tlsConfig.RootCAs = caCertPool
+	var proxyBindAddr, scrapeBindAddr *net.TCPAddr
+	if *proxyBindAddress != "" {
+		if proxyBindAddr, err = parseBindAddress(*proxyBindAddress); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Invalid --proxy.bind-address", "err", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if *scrapeBindAddress != "" {
+		if scrapeBindAddr, err = parseBindAddress(*scrapeBindAddress); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Invalid --scrape.bind-address", "err", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if *scrapeDialBudgetFraction < 0 || *scrapeDialBudgetFraction > 1 {
+		level.Error(coordinator.logger).Log("msg", "--scrape.dial-budget-fraction must be between 0 and 1")
+		os.Exit(exitConfig)
+	}
+	if conflicts := selfScrapeTargets(*metricsAddr, mappedScrapeTargets()); len(conflicts) > 0 && *selfMetricsPath == "" {
+		msg := "Scrape targets are mapped onto the client's own metrics listener, scraping them will fail"
+		if *strictConfig {
+			level.Error(coordinator.logger).Log("msg", msg, "targets", strings.Join(conflicts, ","), "metrics_addr", strings.Join(*metricsAddr, ","))
+			os.Exit(exitConfig)
+		}
+		level.Warn(coordinator.logger).Log("msg", msg, "targets", strings.Join(conflicts, ","), "metrics_addr", strings.Join(*metricsAddr, ","))
+	}
+	if *requireTarget != "" {
+		if err := checkTarget(newDialer(scrapeBindAddr), *requireTarget); err != nil {
+			level.Error(coordinator.logger).Log("msg", "Required target is not reachable", "target", *requireTarget, "err", err)
+			os.Exit(exitConnectivity)
+		}
 	}
 
-	if *metricsAddr != "" {
-		go func() {
-			if err := http.ListenAndServe(*metricsAddr, promhttp.Handler()); err != nil {
-				level.Warn(coordinator.logger).Log("msg", "ListenAndServe", "err", err)
+	pins, err := parseCertPins(*proxyTLSPins)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid --proxy.tls.pin", "err", err)
+		os.Exit(exitConfig)
+	}
+	proxyDialer := withNetwork(dialContext(newDialer(proxyBindAddr)), *proxyDialNetwork)
+	var newProxyTransport func(*tls.Config) *http.Transport
+	if *connectAddr != "" {
+		dialer := newConnectDialer(coordinator.logger, proxyDialer, *connectAddr, *connectRetryMaxAttempts, *connectRetryWait)
+		newProxyTransport = func(tlsConfig *tls.Config) *http.Transport {
+			// The tunnelled connection to the proxy uses the same TLS
+			// settings as a direct one.
+			return &http.Transport{
+				DialContext:     dialer,
+				MaxIdleConns:    100,
+				IdleConnTimeout: 90 * time.Second,
+				TLSClientConfig: proxyTLSConfig(tlsConfig, pins),
 			}
-		}()
+		}
+	} else {
+		newProxyTransport = func(tlsConfig *tls.Config) *http.Transport {
+			return newProxyHTTPTransport(http.ProxyFromEnvironment, proxyDialer, proxyTLSConfig(tlsConfig, pins))
+		}
 	}
 
-	var proxyTransport *http.Transport
-	var scrapeTargetTransport *http.Transport
-	var proxyClient *http.Client
-	var scrapeTargetClient *http.Client
+	scrapeDialer := withNetwork(dialContext(newDialer(scrapeBindAddr)), *scrapeDialNetwork)
+	if *scrapeConnectAddr != "" {
+		scrapeDialer = newConnectDialer(coordinator.logger, scrapeDialer, *scrapeConnectAddr, *connectRetryMaxAttempts, *connectRetryWait)
+	}
+	scrapeDialer = withNoDelay(scrapeDialer, *scrapeTCPNoDelay)
+	newScrapeTransport := func(tlsConfig *tls.Config) *http.Transport {
+		t := newScrapeTargetTransport(scrapeDialer, tlsConfig)
+		t.ResponseHeaderTimeout = time.Duration(coordinator.getConfig().ScrapeResponseHeaderTimeout)
+		return t
+	}
 
-	if *connectAddr != "" {
-		var tempErr error
-	
-		connectAddress := *connectAddr
-		addr := strings.TrimRight(*connectAddr, "/")
-		addr = strings.TrimPrefix(addr, "http://")
-
-		dialer, tempErr := func(ctx context.Context, network, addr string) (net.Conn, error) {
-			var proxyConn net.Conn
-			var err error
-			proxyConn, err = net.Dial("tcp", connectAddress)
-			if err != nil {
-				level.Error(coordinator.logger).Log("msg", "dialing proxy failed:", connectAddress, err)
-				return nil, fmt.Errorf("dialing proxy failed:", connectAddress, err)
-			}
-			fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
-	
-			br := bufio.NewReader(proxyConn)
-			res, err := http.ReadResponse(br, nil)
-	
-			if err != nil {
-				level.Error(coordinator.logger).Log("msg", "reading HTTP response from CONNECT via proxy failed",
-				addr, connectAddress, err)
-				return nil, fmt.Errorf("reading HTTP response from CONNECT via proxy failed", err)
+	proxyTransport := newReloadableTransport(newProxyTransport, tlsConfig)
+	scrapeTargetTransport := newReloadableTransport(newScrapeTransport, tlsConfig)
+	proxyClient := &http.Client{Transport: proxyTransport}
+	scrapeTargetClient := &http.Client{Transport: scrapeTargetTransport}
+
+	// Only the TLS material and --config.file can be reloaded at runtime,
+	// everything else requires a restart. The transports are swapped once the
+	// in-flight scrapes have been drained. Reloads are triggered by SIGHUP
+	// and, with --web.enable-lifecycle, by /-/reload.
+	// tlsConfigMu guards tlsConfig and the transports built from it, which
+	// are replaced both by reloads and by --tls.reload-interval.
+	var tlsConfigMu sync.Mutex
+	reload := func() error {
+		newTLSConfig, err := loadTLSConfig()
+		if err != nil {
+			return err
+		}
+		if *proxyURLFile != "" {
+			if err := checkProxyURLFile(*proxyURLFile, coordinator.getProxyURL()); err != nil {
+				return err
 			}
-	
-			if res.StatusCode != 200 {
-				level.Error(coordinator.logger).Log("msg","proxy error from server while dialing", connectAddress, addr, res.Status)
-				return nil, fmt.Errorf("proxy error from server while dialing", connectAddress, addr, res.Status)
+		}
+		newConfig, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		err = coordinator.drain(*reloadDrainTimeout, func() {
+			// Before the transports are rebuilt, which use the new
+			// scrape_response_header_timeout.
+			coordinator.setConfig(newConfig)
+			tlsConfigMu.Lock()
+			tlsConfig = newTLSConfig
+			proxyTransport.reload(tlsConfig)
+			scrapeTargetTransport.reload(tlsConfig)
+			tlsConfigMu.Unlock()
+			observeCertificate(newTLSConfig)
+			if *proxySignRegistration {
+				coordinator.setRegistrationCert(&newTLSConfig.Certificates[0])
 			}
-	
-			return proxyConn, nil
-		}, nil
+		})
+		if err != nil {
+			return err
+		}
+		reloadsCounter.Inc()
+		return nil
+	}
+	if *caCertFile != "" && *tlsReloadInterval > 0 {
+		// Only the CA pool is replaced, in-flight scrapes keep using the
+		// transport they started with.
+		caReloader := newCAReloader(coordinator.logger, *caCertFile, func(pool *x509.CertPool) {
+			tlsConfigMu.Lock()
+			defer tlsConfigMu.Unlock()
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.RootCAs = pool
+			proxyTransport.reload(tlsConfig)
+			scrapeTargetTransport.reload(tlsConfig)
+		})
+		go caReloader.run(*tlsReloadInterval)
+	}
 
-		if tempErr != nil {
-			level.Error(coordinator.logger).Log("msg","failed to get dialer for proxy client")
+	if *runtimeMetrics {
+		registerRuntimeCollectors(registry)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(*openMetrics, *preferProtobuf))
+	mux.Handle("/-/fqdn", fqdnHandler())
+	mux.Handle("/-/scrapes", scrapesHandler(coordinator))
+	quit := make(chan struct{})
+	if *enableLifecycle {
+		registerLifecycleHandlers(mux, coordinator, reload, quit)
+	}
+	var servers []*http.Server
+	healthMux := mux
+	if *healthAddr != "" {
+		healthMux = http.NewServeMux()
+		servers = append(servers, serve(coordinator.logger, *healthAddr, healthMux, true))
+	}
+	healthMux.Handle("/-/healthy", healthyHandler())
+	var readyTarget *targetCheck
+	if u := readyTargetDefault(); u != "" {
+		readyTarget = &targetCheck{
+			url:     u,
+			client:  scrapeTargetClient,
+			timeout: 5 * time.Second,
+			ttl:     10 * time.Second,
+		}
+	}
+	healthMux.Handle("/-/ready", readyHandler(coordinator, readyTarget))
+	for _, addr := range *metricsAddr {
+		if addr != "" {
+			servers = append(servers, serve(coordinator.logger, addr, mux, !*metricsDisableKeepAlives))
 		}
+	}
+
+	if *watchdogTimeout > 0 {
+		go coordinator.watchdog(*watchdogTimeout)
+	}
+	if *heartbeatInterval > 0 {
+		go coordinator.heartbeat(*heartbeatInterval)
+	}
+	observeFeatures(coordinator.enabledFeatures())
 
-		proxyTransport = &http.Transport{
-			DialContext: dialer,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
+	go coordinator.loop(newBackOffFromFlags(), proxyClient, scrapeTargetClient)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				level.Error(coordinator.logger).Log("msg", "Error reloading configuration", "err", err)
+				continue
+			}
+			level.Info(coordinator.logger).Log("msg", "Completed loading of configuration")
 		}
-	} else {
-		proxyTransport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       tlsConfig,
-		}
-	}
-
-	scrapeTargetTransport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       tlsConfig,
-	}
-
-	proxyClient = &http.Client{Transport: proxyTransport}
-	scrapeTargetClient = &http.Client{Transport: scrapeTargetTransport}
-
-	coordinator.loop(newBackOffFromFlags(), proxyClient, scrapeTargetClient)
-}
\ No newline at end of file
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-term:
+		level.Info(coordinator.logger).Log("msg", "Received signal, exiting gracefully...", "signal", sig)
+	case <-quit:
+		level.Info(coordinator.logger).Log("msg", "Received termination request via web service, exiting gracefully...")
+	}
+	// The proxy forgets about the client once its registration expires.
+	coordinator.stop(*shutdownGracePeriod)
+	for _, srv := range servers {
+		srv.Close()
+	}
+	level.Info(coordinator.logger).Log("msg", "See you next time!")
+}
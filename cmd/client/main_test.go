@@ -14,12 +14,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 )
 
 type TestLogger struct{}
@@ -29,13 +65,15 @@ func (tl *TestLogger) Log(vars ...interface{}) error {
 	return nil
 }
 
-func prepareTest() (*httptest.Server, Coordinator) {
+func prepareTest() (*httptest.Server, *Coordinator) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
 	}))
-	c := Coordinator{logger: &TestLogger{}}
-	*proxyURL = ts.URL
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+	*pushPath = "push"
 	return ts, c
 }
 
@@ -49,7 +87,7 @@ func TestDoScrape(t *testing.T) {
 	}
 	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
 	*myFqdn = ts.URL
-	c.doScrape(req, ts.Client())
+	c.doScrape(req, ts.Client(), ts.Client())
 }
 
 func TestHandleErr(t *testing.T) {
@@ -66,7 +104,3793 @@ func TestHandleErr(t *testing.T) {
 func TestLoop(t *testing.T) {
 	ts, c := prepareTest()
 	defer ts.Close()
-	if err := c.doPoll(ts.Client()); err != nil {
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	reloadErr := errors.New("bad certificate")
+	handler := reloadHandler(&TestLogger{}, func() error { return reloadErr })
+
+	for _, tc := range []struct {
+		method string
+		err    error
+		code   int
+	}{
+		{method: "GET", code: http.StatusMethodNotAllowed},
+		{method: "POST", err: reloadErr, code: http.StatusBadRequest},
+		{method: "POST", err: errDrainInProgress, code: http.StatusConflict},
+		{method: "POST", code: http.StatusOK},
+	} {
+		reloadErr = tc.err
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, "/-/reload", nil))
+		if w.Code != tc.code {
+			t.Errorf("%s with reload error %v: expected %d, got %d", tc.method, tc.err, tc.code, w.Code)
+		}
+	}
+}
+
+func TestValidateEndpointPath(t *testing.T) {
+	for p, valid := range map[string]bool{
+		"poll":                   true,
+		"api/v1/poll":            true,
+		"a/../poll":              true,
+		"":                       false,
+		"/poll":                  false,
+		"../poll":                false,
+		"a/../../poll":           false,
+		"http://evil/poll":       false,
+		"//evil/poll":            false,
+		"http://[::1]:namedport": false,
+	} {
+		err := validateEndpointPath(p)
+		if valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %v", p, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected %q to be invalid", p)
+		}
+	}
+}
+
+func TestDoPushRetry(t *testing.T) {
+	failures := 2
+	pushes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		if pushes <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	c := Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+	*pushRetryInitialWait = time.Millisecond
+	*pushRetryMaxWait = time.Millisecond
+	*pushRetryMaxAttempts = 3
+	defer func() { *pushRetryMaxAttempts = 1 }()
+
+	newResp := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req := httptest.NewRequest("GET", "http://target/metrics", nil).WithContext(ctx)
+	if err := c.doPush(newResp(), req, ts.Client()); err != nil {
+		t.Fatalf("Expected push to succeed after retries, got %v", err)
+	}
+	if pushes != 3 {
+		t.Errorf("Expected 3 push attempts, got %d", pushes)
+	}
+
+	// Retries are not scheduled beyond the scrape deadline.
+	pushes, failures = 0, 100
+	*pushRetryInitialWait = time.Second
+	*pushRetryMaxWait = time.Second
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest("GET", "http://target/metrics", nil).WithContext(ctx)
+	if err := c.doPush(newResp(), req, ts.Client()); err == nil {
+		t.Fatal("Expected push to fail")
+	}
+	if pushes != 1 {
+		t.Errorf("Expected 1 push attempt, got %d", pushes)
+	}
+}
+
+func TestWaitPollInterval(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}}
+	start := time.Now()
+	c.waitPollInterval(time.Second)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected no wait before the first poll, waited %s", elapsed)
+	}
+
+	c.markPollAttempt()
+	c.waitPollInterval(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait at least 50ms since the last poll, waited %s", elapsed)
+	}
+}
+
+func TestPollStalled(t *testing.T) {
+	ts, c := prepareTest()
+	defer ts.Close()
+
+	c.lastPollAttempt = time.Now().Add(-time.Minute)
+	if !c.pollStalled(30 * time.Second) {
+		t.Error("Expected poll to be stalled")
+	}
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if c.pollStalled(30 * time.Second) {
+		t.Error("Expected poll not to be stalled after polling")
+	}
+
+	c.lastPollAttempt = time.Now().Add(-time.Minute)
+	c.drain(time.Second, func() {
+		if c.pollStalled(30 * time.Second) {
+			t.Error("Expected the watchdog to be paused while draining")
+		}
+	})
+	if c.pollStalled(30 * time.Second) {
+		t.Error("Expected the watchdog to start over after draining")
+	}
+}
+
+func TestExpandPathFlags(t *testing.T) {
+	defer func() { *tlsCert, *tlsKey = "", "" }()
+	os.Setenv("PUSHPROX_TEST_CERT_DIR", "/etc/pushprox")
+	defer os.Unsetenv("PUSHPROX_TEST_CERT_DIR")
+
+	*tlsCert = "$PUSHPROX_TEST_CERT_DIR/client.pem"
+	*tlsKey = "${PUSHPROX_TEST_CERT_DIR}/client.key"
+	if err := expandPathFlags(&TestLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	if *tlsCert != "/etc/pushprox/client.pem" || *tlsKey != "/etc/pushprox/client.key" {
+		t.Errorf("Unexpected paths %q and %q", *tlsCert, *tlsKey)
+	}
+
+	*tlsCert = "$PUSHPROX_TEST_UNSET"
+	if err := expandPathFlags(&TestLogger{}); err == nil {
+		t.Error("Expected error for path expanding to nothing")
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}}
+	handler := readyHandler(c, nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d before the first poll, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	c.recordPollResult(errors.New("connection refused"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d after failed poll, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	c.recordPollResult(nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %d after successful poll, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadyTargetDefault(t *testing.T) {
+	defer func(u, l string, ports []string) {
+		*readyTargetURL, *localScrape, *localScrapeAllowedPorts = u, l, ports
+	}(*readyTargetURL, *localScrape, *localScrapeAllowedPorts)
+
+	for _, tc := range []struct {
+		url, local string
+		ports      []string
+		expected   string
+	}{
+		{"", "", nil, ""},
+		{"", "", []string{"9100"}, ""},
+		{"", "true", nil, ""},
+		{"", "true", []string{"9100", "9200"}, "http://localhost:9100/metrics"},
+		{"http://localhost:8080/health", "true", []string{"9100"}, "http://localhost:8080/health"},
+	} {
+		*readyTargetURL, *localScrape, *localScrapeAllowedPorts = tc.url, tc.local, tc.ports
+		if got := readyTargetDefault(); got != tc.expected {
+			t.Errorf("Expected %q for %+v, got %q", tc.expected, tc, got)
+		}
+	}
+}
+
+func TestReadyHandlerDeep(t *testing.T) {
+	up := true
+	scrapes := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes++
+		if !up {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.recordPollResult(nil)
+	check := &targetCheck{url: target.URL, client: target.Client(), timeout: time.Second, ttl: time.Hour}
+
+	ready := func(handler http.Handler) (int, map[string]checkStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready?deep=true", nil))
+		var status map[string]checkStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, status
+	}
+
+	if code, status := ready(readyHandler(c, check)); code != http.StatusOK || !status["target"].OK || !status["proxy"].OK {
+		t.Errorf("Expected deep check to succeed, got %d %v", code, status)
+	}
+	// The result is cached.
+	up = false
+	if code, _ := ready(readyHandler(c, check)); code != http.StatusOK || scrapes != 1 {
+		t.Errorf("Expected cached result, got %d after %d scrapes", code, scrapes)
+	}
+	check.checked = time.Time{}
+	if code, status := ready(readyHandler(c, check)); code != http.StatusServiceUnavailable || status["target"].OK || !status["proxy"].OK {
+		t.Errorf("Expected deep check to fail on the target, got %d %v", code, status)
+	}
+	if code, status := ready(readyHandler(c, nil)); code != http.StatusServiceUnavailable || status["target"].Error == "" {
+		t.Errorf("Expected deep check to fail without target, got %d %v", code, status)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}}
+	c.addScrapesInFlight(1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		c.addScrapesInFlight(-1)
+	}()
+	inFlight := -1
+	c.drain(10*time.Second, func() { inFlight = c.getScrapesInFlight() })
+	if inFlight != 0 {
+		t.Errorf("Expected reload to run once scrapes were drained, ran with %d in flight", inFlight)
+	}
+
+	// Scrapes that don't finish in time don't block the reload.
+	c.addScrapesInFlight(1)
+	defer c.addScrapesInFlight(-1)
+	ran := false
+	c.drain(time.Millisecond, func() { ran = true })
+	if !ran {
+		t.Error("Expected reload to run after drain timeout")
+	}
+
+	// A drain doesn't queue behind another one.
+	done := make(chan error)
+	go func() {
+		done <- c.drain(300*time.Millisecond, func() {})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.drain(10*time.Second, func() { t.Error("Expected the second drain not to run") }); err != errDrainInProgress {
+		t.Errorf("Expected %v while draining, got %v", errDrainInProgress, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the first drain to succeed, got %v", err)
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{errors.Wrap(context.DeadlineExceeded, "failed to scrape"), "timeout"},
+		{&net.DNSError{Err: "no such host", Name: "target"}, "dns"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, "tls"},
+		{errFqdnMismatch, "fqdn-mismatch"},
+		{errors.New("test error"), "other"},
+	} {
+		if got := errorType(tc.err); got != tc.expected {
+			t.Errorf("Expected %q for %v, got %q", tc.expected, tc.err, got)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		errType               string
+		expected, withGateway int
+	}{
+		{"timeout", http.StatusInternalServerError, http.StatusGatewayTimeout},
+		{"dns", http.StatusInternalServerError, http.StatusBadGateway},
+		{"refused", http.StatusInternalServerError, http.StatusBadGateway},
+		{"tls", http.StatusInternalServerError, http.StatusBadGateway},
+		{"fqdn-mismatch", http.StatusInternalServerError, http.StatusInternalServerError},
+		{"scrape-loop", http.StatusInternalServerError, http.StatusInternalServerError},
+		{"port-not-allowed", http.StatusForbidden, http.StatusForbidden},
+		{"paused", http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"truncated", http.StatusBadGateway, http.StatusBadGateway},
+		{"other", http.StatusInternalServerError, http.StatusInternalServerError},
+	} {
+		if got := errorStatus(tc.errType, false); got != tc.expected {
+			t.Errorf("Expected status %d for %s, got %d", tc.expected, tc.errType, got)
+		}
+		if got := errorStatus(tc.errType, true); got != tc.withGateway {
+			t.Errorf("Expected status %d for %s with --push.gateway-status, got %d", tc.withGateway, tc.errType, got)
+		}
+	}
+}
+
+func TestHandleErrGatewayStatus(t *testing.T) {
+	ts, c, pushed := preparePushTest(t)
+	defer ts.Close()
+	*pushGatewayStatus = true
+	defer func() { *pushGatewayStatus = false }()
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	c.handleErr(req, ts.Client(), &net.DNSError{Err: "no such host", Name: "target"})
+	if resp := <-pushed; resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502 for a DNS error, got %d", resp.StatusCode)
+	}
+}
+
+// preparePushTest starts a proxy that hands the responses pushed to it to
+// the returned channel.
+func preparePushTest(t *testing.T) (*httptest.Server, *Coordinator, chan *http.Response) {
+	pushed := make(chan *http.Response, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.ReadResponse(bufio.NewReader(r.Body), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		pushed <- resp
+	}))
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+	return ts, c, pushed
+}
+
+func TestPushUnknownScrape(t *testing.T) {
+	pushes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		w.Header().Set(util.ErrorHeader, util.UnknownScrapeError)
+		http.Error(w, "unknown scrape id", http.StatusNotFound)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+	defer func(v int) { *pushRetryMaxAttempts = v }(*pushRetryMaxAttempts)
+	*pushRetryMaxAttempts = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.setCancelPollWait(cancel)
+	before := testutil.ToFloat64(repollsCounter)
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	req.Header.Set("id", "old-scrape")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	if err := c.doPush(resp, req, ts.Client()); !errors.Is(err, errUnknownScrape) {
+		t.Fatalf("Expected errUnknownScrape, got %v", err)
+	}
+	if pushes != 1 {
+		t.Errorf("Expected pushes of unknown scrapes not to be retried, got %d pushes", pushes)
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected the wait before the next poll to be cut short")
+	}
+	if got := testutil.ToFloat64(repollsCounter) - before; got != 1 {
+		t.Errorf("Expected 1 repoll, got %f", got)
+	}
+}
+
+func TestPushExpiredScrape(t *testing.T) {
+	pushes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		w.Header().Set(util.ErrorHeader, util.ExpiredScrapeError)
+		http.Error(w, "scrape already timed out", http.StatusGone)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+	defer func(v int) { *pushRetryMaxAttempts = v }(*pushRetryMaxAttempts)
+	*pushRetryMaxAttempts = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.setCancelPollWait(cancel)
+	before := testutil.ToFloat64(repollsCounter)
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	req.Header.Set("id", "slow-scrape")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	if err := c.doPush(resp, req, ts.Client()); !errors.Is(err, errExpiredScrape) {
+		t.Fatalf("Expected errExpiredScrape, got %v", err)
+	}
+	if pushes != 1 {
+		t.Errorf("Expected pushes of expired scrapes not to be retried, got %d pushes", pushes)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected no repoll for an expired scrape")
+	}
+	if got := testutil.ToFloat64(repollsCounter) - before; got != 0 {
+		t.Errorf("Expected no repolls, got %f", got)
+	}
+}
+
+func TestHandleErrResponse(t *testing.T) {
+	ts, c, pushed := preparePushTest(t)
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	c.handleErr(req, ts.Client(), errors.New("test error"))
+	resp := <-pushed
+	if resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+		t.Errorf("Expected HTTP/1.1 response, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Expected plain text content type, got %q", got)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "test error" || resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 {
+		t.Errorf("Expected body %q with matching content length, got %q with %d, transfer encoding %v", "test error", body, resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+func TestHandleErrJSON(t *testing.T) {
+	ts, c, pushed := preparePushTest(t)
+	defer ts.Close()
+	defer func(v string) { *pushErrorFormat = v }(*pushErrorFormat)
+	*pushErrorFormat = "json"
+	*myFqdn = "client.example.com"
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	req.Header.Set("id", "scrape-id")
+	c.handleErr(req, ts.Client(), errors.Wrap(context.DeadlineExceeded, "failed to scrape"))
+	resp := <-pushed
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected content type application/json, got %q", got)
+	}
+	var body scrapeError
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := scrapeError{
+		Error:    "failed to scrape: context deadline exceeded",
+		Type:     "timeout",
+		ScrapeID: "scrape-id",
+		FQDN:     "client.example.com",
+	}
+	if body != expected {
+		t.Errorf("Expected error body %+v, got %+v", expected, body)
+	}
+}
+
+func TestHandleErrType(t *testing.T) {
+	ts, c, pushed := preparePushTest(t)
+	defer ts.Close()
+
+	req := httptest.NewRequest("GET", "http://target/metrics", nil)
+	c.handleErr(req, ts.Client(), errors.Wrap(context.DeadlineExceeded, "failed to scrape"))
+	if got := (<-pushed).Header.Get(errorTypeHeader); got != "timeout" {
+		t.Errorf("Expected error type timeout, got %q", got)
+	}
+}
+
+func TestDoScrapeHostHeader(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer target.Close()
+
+	*myFqdn = "127.0.0.1"
+	*scrapeHostHeader = "exporter.example.com"
+	defer func() { *scrapeHostHeader = "" }()
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	body, err := ioutil.ReadAll((<-pushed).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "exporter.example.com" {
+		t.Errorf("Expected Host header exporter.example.com to reach the target, got %q", body)
+	}
+}
+
+func TestReadProxyURLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "proxy-url")
+
+	for content, expected := range map[string]string{
+		"http://proxy:8080\n":     "http://proxy:8080",
+		"  https://proxy/push \n": "https://proxy/push",
+		"":                        "",
+		"\n":                      "",
+		"proxy:8080":              "",
+		"http://a\nhttp://b\n":    "",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readProxyURLFile(filename)
+		if expected == "" && err == nil {
+			t.Errorf("Expected error for %q, got %q", content, got)
+		}
+		if expected != "" && (err != nil || got != expected) {
+			t.Errorf("Expected %q for %q, got %q (err: %v)", expected, content, got, err)
+		}
+	}
+}
+
+func TestCheckProxyURLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "proxy-url")
+	if err := ioutil.WriteFile(filename, []byte("http://proxy:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkProxyURLFile(filename, "http://proxy:8080/"); err != nil {
+		t.Errorf("Expected an unchanged proxy url to be accepted, got %v", err)
+	}
+	err = checkProxyURLFile(filename, "http://old-proxy:8080/")
+	if err == nil || !strings.Contains(err.Error(), "requires a restart") {
+		t.Errorf("Expected a changed proxy url to require a restart, got %v", err)
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	for enabled, contentType := range map[bool]string{
+		true:  "application/openmetrics-text",
+		false: "text/plain",
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		w := httptest.NewRecorder()
+		metricsHandler(enabled, false).ServeHTTP(w, req)
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+			t.Errorf("Expected content type %s with OpenMetrics enabled=%t, got %s", contentType, enabled, got)
+		}
+	}
+}
+
+func TestMetricsHandlerPreferProtobuf(t *testing.T) {
+	for _, tc := range []struct {
+		accept         string
+		openMetrics    bool
+		preferProtobuf bool
+		contentType    string
+	}{
+		{
+			accept:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+			contentType: "application/vnd.google.protobuf",
+		},
+		{
+			accept:      "text/plain;version=0.0.4,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.5",
+			contentType: "text/plain",
+		},
+		{
+			accept:         "text/plain;version=0.0.4,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.5",
+			preferProtobuf: true,
+			contentType:    "application/vnd.google.protobuf",
+		},
+		{
+			accept:         "application/openmetrics-text;version=0.0.1,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.5",
+			openMetrics:    true,
+			preferProtobuf: true,
+			contentType:    "application/vnd.google.protobuf",
+		},
+		{
+			accept:         "application/openmetrics-text;version=0.0.1,text/plain;q=0.5",
+			openMetrics:    true,
+			preferProtobuf: true,
+			contentType:    "application/openmetrics-text",
+		},
+		{
+			accept:         "text/plain,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0",
+			preferProtobuf: true,
+			contentType:    "text/plain",
+		},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		metricsHandler(tc.openMetrics, tc.preferProtobuf).ServeHTTP(w, req)
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.contentType) {
+			t.Errorf("Expected content type %s for %q with prefer protobuf=%t, got %s", tc.contentType, tc.accept, tc.preferProtobuf, got)
+		}
+	}
+}
+
+// recordingTransport records the URLs of the requests it gets.
+type recordingTransport struct {
+	urls chan string
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.urls <- r.URL.String()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDoScrapeURLRewrite(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	target := &recordingTransport{urls: make(chan string, 1)}
+	*myFqdn = "127.0.0.1"
+	defer func() { *localScrape = "" }()
+
+	for _, tc := range []struct {
+		url, localScrape, rewrite, expected string
+	}{
+		{
+			url:      "http://127.0.0.1:9100/metrics?_scheme=https",
+			rewrite:  "^https://127.0.0.1:9100/=https://127.0.0.1:9101/",
+			expected: "https://127.0.0.1:9101/metrics",
+		},
+		{
+			url:         "http://127.0.0.1:9100/metrics",
+			localScrape: "true",
+			rewrite:     "localhost:(\\d+)=localhost:1$1",
+			expected:    "http://localhost:19100/metrics",
+		},
+		{
+			url:      "http://127.0.0.1:9100/metrics",
+			rewrite:  "/metrics$=/federate",
+			expected: "http://127.0.0.1:9100/federate",
+		},
+	} {
+		rewrite, err := parseURLRewrite(tc.rewrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.urlRewrite = rewrite
+		*localScrape = tc.localScrape
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.RequestURI = ""
+		req.Header.Add("id", "scrape-id")
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), &http.Client{Transport: target})
+
+		if got := <-target.urls; got != tc.expected {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", tc.url, tc.expected, got)
+		}
+		if id := (<-pushed).Header.Get("id"); id != "scrape-id" {
+			t.Errorf("Expected pushed response for scrape-id, got %q", id)
+		}
+	}
+}
+
+func TestDoScrapeLocalScrapeAllowedPorts(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	target := &recordingTransport{urls: make(chan string, 1)}
+	*myFqdn = "127.0.0.1"
+	*localScrape = "true"
+	*localScrapeAllowedPorts = []string{"9100"}
+	defer func() {
+		*localScrape = ""
+		*localScrapeAllowedPorts = nil
+	}()
+
+	for _, tc := range []struct {
+		url        string
+		statusCode int
+	}{
+		{url: "http://127.0.0.1:9100/metrics", statusCode: http.StatusOK},
+		{url: "http://127.0.0.1:22/metrics", statusCode: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.RequestURI = ""
+		req.Header.Add("id", "scrape-id")
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), &http.Client{Transport: target})
+
+		resp := <-pushed
+		if resp.StatusCode != tc.statusCode {
+			t.Errorf("Expected status %d for %s, got %d", tc.statusCode, tc.url, resp.StatusCode)
+		}
+		if tc.statusCode == http.StatusOK {
+			if got := <-target.urls; got != "http://localhost:9100/metrics" {
+				t.Errorf("Expected localhost:9100 to be scraped, got %s", got)
+			}
+			continue
+		}
+		if got := resp.Header.Get(errorTypeHeader); got != "port-not-allowed" {
+			t.Errorf("Expected error type port-not-allowed, got %q", got)
+		}
+		select {
+		case got := <-target.urls:
+			t.Errorf("Expected no scrape for %s, got %s", tc.url, got)
+		default:
+		}
+	}
+}
+
+func TestDoScrapeLocalScrapeRewrites(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	target := &recordingTransport{urls: make(chan string, 1)}
+	*localScrape = "true"
+	defer func() { *localScrape = "" }()
+
+	for _, tc := range []struct {
+		fqdn, url, expected string
+		rewritten, skipped  float64
+	}{
+		{fqdn: "127.0.0.1", url: "http://127.0.0.1:9100/metrics", expected: "http://localhost:9100/metrics", rewritten: 1},
+		{fqdn: "fd00::1", url: "http://[fd00::1]:9100/metrics", expected: "http://localhost:9100/metrics", rewritten: 1},
+		{fqdn: "127.0.0.1", url: "http://127.0.0.1/metrics", expected: "http://127.0.0.1/metrics", skipped: 1},
+	} {
+		*myFqdn = tc.fqdn
+		rewrittenBefore := testutil.ToFloat64(localScrapeRewritesCounter)
+		skippedBefore := testutil.ToFloat64(localScrapeRewritesSkippedCounter)
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), &http.Client{Transport: target})
+		<-pushed
+
+		if got := <-target.urls; got != tc.expected {
+			t.Errorf("Expected %s to be scraped as %s, got %s", tc.url, tc.expected, got)
+		}
+		if got := testutil.ToFloat64(localScrapeRewritesCounter) - rewrittenBefore; got != tc.rewritten {
+			t.Errorf("Expected %f rewrites for %s, got %f", tc.rewritten, tc.url, got)
+		}
+		if got := testutil.ToFloat64(localScrapeRewritesSkippedCounter) - skippedBefore; got != tc.skipped {
+			t.Errorf("Expected %f skipped rewrites for %s, got %f", tc.skipped, tc.url, got)
+		}
+	}
+}
+
+func TestParseURLRewrite(t *testing.T) {
+	for _, s := range []string{"", "=foo", "no-separator", "(=foo"} {
+		if _, err := parseURLRewrite(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
+
+func TestDoPollTraceTimings(t *testing.T) {
+	ts, c := prepareTest()
+	defer ts.Close()
+	*tracePollTimings = true
+	defer func() { *tracePollTimings = false }()
+
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	var m dto.Metric
+	if err := pollTTFBHistogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetHistogram().GetSampleCount() == 0 {
+		t.Error("Expected time to first byte to be observed")
+	}
+}
+
+func TestDoPollGzip(t *testing.T) {
+	acceptEncoding := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding <- r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, "GET http://127.0.0.1:1/metrics HTTP/1.1\r\nHost: 127.0.0.1:1\r\nId: gzipped\r\nX-Prometheus-Scrape-Timeout-Seconds: 10\r\n\r\n")
+		gz.Close()
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+	*pushPath = "push"
+	*myFqdn = "127.0.0.1"
+
+	target := &recordingTransport{urls: make(chan string, 1)}
+	if err := c.doPoll(ts.Client(), &http.Client{Transport: target}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-acceptEncoding; got != "gzip" {
+		t.Errorf("Expected Accept-Encoding gzip, got %q", got)
+	}
+	if got := <-target.urls; got != "http://127.0.0.1:1/metrics" {
+		t.Errorf("Expected scrape of decompressed request, got %s", got)
+	}
+}
+
+func TestPushBuffer(t *testing.T) {
+	b := newPushBuffer(2, time.Minute)
+	b.add("1", []byte("a"), time.Time{})
+	b.add("2", []byte("b"), time.Time{})
+	b.add("3", []byte("c"), time.Time{})
+	pushes := b.startFlush()
+	if len(pushes) != 2 || pushes[0].id != "2" || pushes[1].id != "3" {
+		t.Fatalf("Expected the oldest push to be dropped, got %+v", pushes)
+	}
+	if b.startFlush() != nil {
+		t.Error("Expected no concurrent flush")
+	}
+	b.add("4", []byte("d"), time.Time{})
+	b.endFlush(pushes[1:])
+	if pushes = b.startFlush(); len(pushes) != 2 || pushes[0].id != "3" || pushes[1].id != "4" {
+		t.Fatalf("Expected unsent pushes to be kept in order, got %+v", pushes)
+	}
+	b.endFlush(nil)
+
+	b = newPushBuffer(2, -time.Second)
+	b.add("1", []byte("a"), time.Time{})
+	if pushes = b.startFlush(); len(pushes) != 0 {
+		t.Errorf("Expected expired pushes to be dropped, got %+v", pushes)
+	}
+
+	b = newPushBuffer(2, time.Minute)
+	b.add("timed-out", []byte("a"), time.Now().Add(-time.Second))
+	b.add("pending", []byte("b"), time.Now().Add(time.Hour))
+	if pushes = b.startFlush(); len(pushes) != 1 || pushes[0].id != "pending" {
+		t.Errorf("Expected the push of the timed out scrape to be dropped, got %+v", pushes)
+	}
+	if pushes[0].expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected pushes to expire after the TTL at the latest, got %s", pushes[0].expires)
+	}
+}
+
+func TestFlushPushBufferSkipsTimedOutScrapes(t *testing.T) {
+	pushes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}, pushBuffer: newPushBuffer(10, time.Minute)}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+
+	c.pushBuffer.add("timed-out", []byte("a"), time.Now().Add(-time.Second))
+	c.flushPushBuffer(ts.Client())
+	if pushes != 0 {
+		t.Errorf("Expected the push of a timed out scrape not to be replayed, got %d pushes", pushes)
+	}
+}
+
+func TestDoPushBuffered(t *testing.T) {
+	proxyUp := false
+	pushed := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !proxyUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(r.Body), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pushed <- resp.Header.Get("id")
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}, pushBuffer: newPushBuffer(10, time.Minute)}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+
+	push := func(id string) error {
+		req := httptest.NewRequest("GET", "http://target/metrics", nil)
+		req.Header.Set("id", id)
+		return c.doPush(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, req, ts.Client())
+	}
+	if err := push("buffered"); err == nil {
+		t.Fatal("Expected push to fail")
+	}
+	proxyUp = true
+	if err := push("direct"); err != nil {
 		t.Fatal(err)
 	}
+	for _, expected := range []string{"direct", "buffered"} {
+		if id := <-pushed; id != expected {
+			t.Errorf("Expected push of %s, got %s", expected, id)
+		}
+	}
+}
+
+func TestServeKeepAlives(t *testing.T) {
+	for _, keepAlives := range []bool{true, false} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		srv := serve(&TestLogger{}, addr, healthyHandler(), keepAlives)
+
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr + "/"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+		if resp.Close == keepAlives {
+			t.Errorf("Expected Connection: close to be %t with keep-alives %t", !keepAlives, keepAlives)
+		}
+	}
+}
+
+func TestFQDNHandler(t *testing.T) {
+	*myFqdn = "client.example.com"
+	w := httptest.NewRecorder()
+	fqdnHandler().ServeHTTP(w, httptest.NewRequest("GET", "/-/fqdn", nil))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected JSON, got %s", got)
+	}
+	if got, expected := w.Body.String(), `{"fqdns":["client.example.com"]}`+"\n"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestInFlightScrapes(t *testing.T) {
+	var s inFlightScrapes
+	now := time.Now()
+	done := s.start("a", "host:9100", now.Add(-3*time.Second))
+	s.start("b", "host:9101", now.Add(-time.Second))
+	s.start("a", "host:9102", now.Add(-2*time.Second))
+
+	scrapes, total := s.list(now, 2)
+	expected := []scrapeStatus{{"a", "host:9100", 3}, {"a", "host:9102", 2}}
+	if total != 3 || !reflect.DeepEqual(scrapes, expected) {
+		t.Errorf("Expected %v of 3 scrapes, got %v of %d", expected, scrapes, total)
+	}
+	done()
+	if _, total := s.list(now, 2); total != 2 {
+		t.Errorf("Expected 2 scrapes once one is done, got %d", total)
+	}
+}
+
+func TestScrapesHandler(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}}
+	w := httptest.NewRecorder()
+	scrapesHandler(c).ServeHTTP(w, httptest.NewRequest("GET", "/-/scrapes", nil))
+	if got, expected := w.Body.String(), `{"scrapes":[],"total":0}`+"\n"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	c.inFlight.start("1", "host:9100", time.Now())
+	w = httptest.NewRecorder()
+	scrapesHandler(c).ServeHTTP(w, httptest.NewRequest("GET", "/-/scrapes", nil))
+	var got struct {
+		Scrapes []scrapeStatus `json:"scrapes"`
+		Total   int            `json:"total"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Total != 1 || len(got.Scrapes) != 1 || got.Scrapes[0].ScrapeID != "1" || got.Scrapes[0].Target != "host:9100" {
+		t.Errorf("Expected scrape 1 of host:9100, got %+v", got)
+	}
+}
+
+func TestQuitHandler(t *testing.T) {
+	quit := make(chan struct{})
+	handler := quitHandler(quit)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/quit", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d for GET, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	select {
+	case <-quit:
+		t.Fatal("Expected no shutdown on GET")
+	default:
+	}
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/-/quit", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %d for POST, got %d", http.StatusOK, w.Code)
+		}
+	}
+	<-quit
+}
+
+func TestPauseHandler(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	defer c.setPaused(false)
+	scraped := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scraped <- struct{}{}
+	}))
+	defer target.Close()
+
+	w := httptest.NewRecorder()
+	pauseHandler(c, true).ServeHTTP(w, httptest.NewRequest("GET", "/-/pause", nil))
+	if w.Code != http.StatusMethodNotAllowed || c.isPaused() {
+		t.Errorf("Expected GET to be refused without pausing, got %d", w.Code)
+	}
+
+	for _, paused := range []bool{true, false} {
+		w = httptest.NewRecorder()
+		pauseHandler(c, paused).ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %d for POST, got %d", http.StatusOK, w.Code)
+		}
+		if got := testutil.ToFloat64(pausedGauge); got != map[bool]float64{true: 1, false: 0}[paused] {
+			t.Errorf("Expected paused gauge for paused=%t, got %f", paused, got)
+		}
+
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+		resp := <-pushed
+		if paused {
+			if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(errorTypeHeader) != "paused" {
+				t.Errorf("Expected paused 503 while paused, got %d %q", resp.StatusCode, resp.Header.Get(errorTypeHeader))
+			}
+			select {
+			case <-scraped:
+				t.Error("Expected no scrape while paused")
+			default:
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected %d after resuming, got %d", http.StatusOK, resp.StatusCode)
+		}
+		<-scraped
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to dir.
+func writeTestCertificate(t *testing.T, dir string, notBefore, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pushprox-client"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestSignRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*tlsCert, *tlsKey = writeTestCertificate(t, dir, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	defer func() { *tlsCert, *tlsKey = "", "" }()
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsConfig.Certificates[0].Leaf)
+
+	verified := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fqdn, _ := ioutil.ReadAll(r.Body)
+		verified <- util.VerifyRegistration(r.Header, string(fqdn), roots, time.Now(), time.Minute)
+		http.Error(w, "no scrape", http.StatusRequestTimeout)
+	}))
+	defer ts.Close()
+	*myFqdn = "localhost"
+	*pollPath = "poll"
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	c.setRegistrationCert(&tlsConfig.Certificates[0])
+
+	c.doPoll(ts.Client(), ts.Client())
+	if err := <-verified; err != nil {
+		t.Errorf("Expected poll registration to be signed, got %v", err)
+	}
+}
+
+func TestObserveCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notBefore := time.Unix(1600000000, 0)
+	notAfter := time.Unix(1900000000, 0)
+	*tlsCert, *tlsKey = writeTestCertificate(t, dir, notBefore, notAfter)
+	defer func() { *tlsCert, *tlsKey = "", "" }()
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observeCertificate(tlsConfig)
+	if got := testutil.ToFloat64(tlsCertNotAfterGauge); got != float64(notAfter.Unix()) {
+		t.Errorf("Expected not after %d, got %f", notAfter.Unix(), got)
+	}
+	if got := testutil.ToFloat64(tlsCertNotBeforeGauge); got != float64(notBefore.Unix()) {
+		t.Errorf("Expected not before %d, got %f", notBefore.Unix(), got)
+	}
+}
+
+func TestLoadTLSConfigVersionAndCipherSuites(t *testing.T) {
+	defer func() {
+		*tlsMinVersion = ""
+		*tlsCipherSuites = nil
+	}()
+
+	*tlsMinVersion = "1.3"
+	*tlsCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected minimum version TLS 1.3, got %x", tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Expected only TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, got %v", tlsConfig.CipherSuites)
+	}
+	if scrapeTLSConfig(tlsConfig).MinVersion != tls.VersionTLS13 {
+		t.Error("Expected the scrape TLS config to keep the minimum version")
+	}
+
+	for _, tc := range []struct {
+		version string
+		suites  []string
+	}{
+		{version: "1.4"},
+		{version: "TLS13"},
+		{suites: []string{"TLS_NOT_A_CIPHER"}},
+		{suites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{suites: []string{"TLS_AES_128_GCM_SHA256"}},
+	} {
+		*tlsMinVersion, *tlsCipherSuites = tc.version, tc.suites
+		if _, err := newTLSConfig(); err == nil {
+			t.Errorf("Expected flag error for version %q and cipher suites %v", tc.version, tc.suites)
+		}
+		if _, err := loadTLSConfig(); err == nil {
+			t.Errorf("Expected error for version %q and cipher suites %v", tc.version, tc.suites)
+		}
+	}
+}
+
+func TestCAReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, _ := writeTestCertificate(t, dir, time.Now(), time.Now().Add(time.Hour))
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := 0
+	r := newCAReloader(&TestLogger{}, caFile, func(*x509.CertPool) { applied++ })
+	r.check()
+	if applied != 0 {
+		t.Errorf("Expected unchanged CA file not to be applied, got %d applies", applied)
+	}
+
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.check()
+	if applied != 0 {
+		t.Errorf("Expected invalid CA file not to be applied, got %d applies", applied)
+	}
+
+	if err := ioutil.WriteFile(caFile, caCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.check()
+	if applied != 1 {
+		t.Errorf("Expected changed CA file to be applied once, got %d applies", applied)
+	}
+}
+
+func TestLogHeartbeat(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Coordinator{logger: log.NewLogfmtLogger(&buf)}
+	c.addScrapesInFlight(2)
+	c.addScrapesInFlight(-2)
+	c.setPollBackoff(5 * time.Second)
+	c.logHeartbeat()
+	for _, expected := range []string{"last_successful_poll=never", "poll_ok=true", "scrapes=2", "poll_backoff=5s"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected heartbeat to contain %s, got %q", expected, buf.String())
+		}
+	}
+
+	buf.Reset()
+	c.recordPollResult(nil)
+	c.logHeartbeat()
+	if !strings.Contains(buf.String(), "scrapes=0") || strings.Contains(buf.String(), "last_successful_poll=never") {
+		t.Errorf("Expected heartbeat with a successful poll and no new scrapes, got %q", buf.String())
+	}
+}
+
+func TestDoScrapeBearerToken(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	authorization := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.scrapeToken = &tokenFile{file: tokenPath, ttl: time.Minute, now: time.Now}
+
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	if got := <-authorization; got != "Bearer secret-token" {
+		t.Errorf("Expected target to get the bearer token, got %q", got)
+	}
+	resp := <-pushed
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Authorization") != "" || strings.Contains(string(body), "secret-token") {
+		t.Errorf("Expected the bearer token not to be pushed, got headers %v and body %q", resp.Header, body)
+	}
+}
+
+func TestDoScrapePreScrapeCommand(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	*preScrapeCommandHeader = "X-Token"
+	defer func() { *preScrapeCommandHeader = "" }()
+	tokens := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("X-Token")
+	}))
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Prints how often it has been run.
+	command := filepath.Join(dir, "token.sh")
+	script := "#!/bin/sh\necho run >> " + filepath.Join(dir, "runs") + "\nwc -l < " + filepath.Join(dir, "runs") + "\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	c.preScrapeToken = &commandToken{command: command, ttl: time.Minute, now: func() time.Time { return now }}
+
+	for _, tc := range []struct {
+		after    time.Duration
+		expected string
+	}{
+		{0, "1"},
+		{30 * time.Second, "1"},
+		{time.Minute, "2"},
+	} {
+		now = now.Add(tc.after)
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+		if got := <-tokens; got != tc.expected {
+			t.Errorf("Expected token %q, got %q", tc.expected, got)
+		}
+		<-pushed
+	}
+
+	before := testutil.ToFloat64(preScrapeCommandFailuresCounter)
+	c.preScrapeToken = &commandToken{command: filepath.Join(dir, "missing"), ttl: time.Minute, now: time.Now}
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+	if resp := <-pushed; resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected failing command to fail the scrape, got %d", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(preScrapeCommandFailuresCounter) - before; got != 1 {
+		t.Errorf("Expected 1 failed command, got %f", got)
+	}
+}
+
+func stringPtr(s string) *string { return &s }
+
+func TestTokenFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	f := &tokenFile{file: tokenPath, ttl: time.Minute, now: func() time.Time { return now }}
+
+	for _, tc := range []struct {
+		after    time.Duration
+		content  *string
+		expected string
+	}{
+		{expected: "first"},
+		// Cached until the ttl has passed.
+		{after: 30 * time.Second, content: stringPtr("second"), expected: "first"},
+		{after: time.Minute, expected: "second"},
+		// Unusable files keep the previous token.
+		{after: time.Minute, content: stringPtr(""), expected: "second"},
+	} {
+		now = now.Add(tc.after)
+		if tc.content != nil {
+			if err := ioutil.WriteFile(tokenPath, []byte(*tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := f.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.expected {
+			t.Errorf("Expected token %q, got %q", tc.expected, got)
+		}
+	}
+}
+
+func TestDoScrapeHeadersTooLarge(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Large", strings.Repeat("x", 4096))
+	}))
+	defer target.Close()
+	client := &http.Client{Transport: &http.Transport{MaxResponseHeaderBytes: 1024}}
+
+	before := testutil.ToFloat64(scrapeHeadersTooLargeCounter)
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), client)
+
+	resp := <-pushed
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("X-Large") != "" {
+		t.Errorf("Expected a 500 without the large header, got %d with headers %v", resp.StatusCode, resp.Header)
+	}
+	if got := testutil.ToFloat64(scrapeHeadersTooLargeCounter) - before; got != 1 {
+		t.Errorf("Expected 1 scrape with too large headers, got %f", got)
+	}
+}
+
+func TestDoScrapeLastSuccessfulPush(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	host := strings.TrimPrefix(target.URL, "http://")
+
+	before := time.Now().Unix()
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+	<-pushed
+
+	if got := testutil.ToFloat64(lastSuccessfulPushGauge.WithLabelValues(host)); got < float64(before) {
+		t.Errorf("Expected last successful push of %s after %d, got %f", host, before, got)
+	}
+}
+
+func TestDoScrapeConsecutiveFailures(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	var result string
+	target := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		switch result {
+		case "refused":
+			return nil, errors.New("connection refused")
+		case "truncated":
+			// The target responds, but the body ends early.
+			body := io.MultiReader(strings.NewReader("up "), iotest.ErrReader(io.ErrUnexpectedEOF))
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(body), Request: r}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})}
+
+	for _, tc := range []struct {
+		result   string
+		expected float64
+	}{
+		{"refused", 1},
+		{"refused", 2},
+		{"ok", 0},
+		{"refused", 1},
+		{"truncated", 2},
+		{"ok", 0},
+	} {
+		result = tc.result
+		req := httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target)
+		<-pushed
+		if got := testutil.ToFloat64(scrapeConsecutiveFailuresGauge.WithLabelValues("127.0.0.1:9100")); got != tc.expected {
+			t.Errorf("Expected %f consecutive failures after %s scrape, got %f", tc.expected, tc.result, got)
+		}
+	}
+}
+
+func TestTargetLabeler(t *testing.T) {
+	l := &targetLabeler{max: 2}
+	for _, tc := range []struct {
+		target, expected string
+	}{
+		{"a:9100", "a:9100"},
+		{"b:9100", "b:9100"},
+		{"c:9100", otherTarget},
+		{"a:9100", "a:9100"},
+	} {
+		if got := l.label(tc.target); got != tc.expected {
+			t.Errorf("Expected label %q for %q, got %q", tc.expected, tc.target, got)
+		}
+	}
+	var unlimited *targetLabeler
+	if got := unlimited.label("c:9100"); got != "c:9100" {
+		t.Errorf("Expected nil labeler not to limit targets, got %q", got)
+	}
+}
+
+func TestDoScrapeResponseHeaderTimeout(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall-headers" {
+			time.Sleep(500 * time.Millisecond)
+			return
+		}
+		// Send the headers, then stall on the body.
+		w.(http.Flusher).Flush()
+		time.Sleep(500 * time.Millisecond)
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	defer func(v time.Duration) { *scrapeResponseHeaderTimeout = v }(*scrapeResponseHeaderTimeout)
+	*scrapeResponseHeaderTimeout = 100 * time.Millisecond
+	client := &http.Client{Transport: newScrapeTargetTransport(dialContext(&net.Dialer{}), nil)}
+
+	for path, expected := range map[string]int{
+		"/stall-headers": http.StatusInternalServerError,
+		"/stall-body":    http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", target.URL+path, nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), client)
+		if resp := <-pushed; resp.StatusCode != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestScrapeFreshConnections(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	defer func(v bool) { *scrapeFreshConnections = v }(*scrapeFreshConnections)
+
+	for _, fresh := range []bool{false, true} {
+		newConns := make(chan struct{}, 10)
+		target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "up 1\n")
+		}))
+		target.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns <- struct{}{}
+			}
+		}
+		target.Start()
+		*scrapeFreshConnections = fresh
+		client := &http.Client{Transport: newScrapeTargetTransport(dialContext(&net.Dialer{}), nil)}
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+			req.RequestURI = ""
+			req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+			c.doScrape(req, proxy.Client(), client)
+			if resp := <-pushed; resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected scrape to succeed, got %d", resp.StatusCode)
+			}
+		}
+		target.Close()
+		expected := 1
+		if fresh {
+			expected = 2
+		}
+		if got := len(newConns); got != expected {
+			t.Errorf("Expected %d connections for two scrapes with fresh connections %v, got %d", expected, fresh, got)
+		}
+	}
+}
+
+func TestDoScrapeCompression(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	acceptEncodings := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodings <- r.Header.Get("Accept-Encoding")
+		if !acceptsGzip(r.Header) {
+			io.WriteString(w, "up 1\n")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, "up 1\n")
+		gz.Close()
+	}))
+	defer target.Close()
+	defer func(acceptGzip bool, compression string) {
+		*scrapeAcceptGzip, *pushCompression = acceptGzip, compression
+	}(*scrapeAcceptGzip, *pushCompression)
+
+	for _, tc := range []struct {
+		acceptGzip      bool
+		pushCompression string
+		// Accept-Encoding of the scrape request from Prometheus.
+		prometheusAccept string
+		pushedEncoding   string
+	}{
+		{acceptGzip: false, pushCompression: "none", prometheusAccept: "gzip", pushedEncoding: ""},
+		{acceptGzip: true, pushCompression: "none", prometheusAccept: "gzip", pushedEncoding: ""},
+		{acceptGzip: false, pushCompression: "gzip", prometheusAccept: "gzip", pushedEncoding: "gzip"},
+		{acceptGzip: true, pushCompression: "gzip", prometheusAccept: "gzip", pushedEncoding: "gzip"},
+		{acceptGzip: true, pushCompression: "gzip", prometheusAccept: "identity", pushedEncoding: ""},
+	} {
+		*scrapeAcceptGzip, *pushCompression = tc.acceptGzip, tc.pushCompression
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		req.Header.Set("Accept-Encoding", tc.prometheusAccept)
+		// Use a transport of its own, so that the transparent
+		// decompression of the transport is tested.
+		c.doScrape(req, proxy.Client(), &http.Client{Transport: &http.Transport{}})
+
+		acceptEncoding := <-acceptEncodings
+		if got := strings.Contains(acceptEncoding, "gzip"); got != tc.acceptGzip {
+			t.Errorf("Expected target to be asked for gzip=%t, got Accept-Encoding %q", tc.acceptGzip, acceptEncoding)
+		}
+		resp := <-pushed
+		if got := resp.Header.Get("Content-Encoding"); got != tc.pushedEncoding {
+			t.Errorf("Expected pushed Content-Encoding %q for %+v, got %q", tc.pushedEncoding, tc, got)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("Expected Content-Length %d to match the body for %+v, got %d", len(body), tc, resp.ContentLength)
+		}
+		if tc.pushedEncoding == "gzip" {
+			if body, err = gunzip(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != "up 1\n" {
+			t.Errorf("Expected pushed body %q for %+v, got %q", "up 1\n", tc, body)
+		}
+	}
+}
+
+func TestDoScrapeEmptyBody(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+
+	for _, tc := range []struct {
+		status        int
+		contentLength string
+		expected      int
+	}{
+		{status: http.StatusOK, expected: http.StatusOK},
+		{status: http.StatusNoContent, expected: http.StatusNoContent},
+		{status: http.StatusNotModified, expected: http.StatusNotModified},
+		// The body is shorter than announced.
+		{status: http.StatusOK, contentLength: "5", expected: http.StatusBadGateway},
+	} {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentLength != "" {
+				w.Header().Set("Content-Length", tc.contentLength)
+			}
+			w.WriteHeader(tc.status)
+		}))
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+		target.Close()
+
+		resp := <-pushed
+		if resp.StatusCode != tc.expected {
+			t.Errorf("Expected pushed status %d for %d, got %d", tc.expected, tc.status, resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if tc.expected/100 == 2 && (len(body) != 0 || resp.ContentLength > 0) {
+			t.Errorf("Expected empty body for %d, got %q with content length %d", tc.status, body, resp.ContentLength)
+		}
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	if _, err := parseBindAddress("example.com"); err == nil {
+		t.Error("Expected error for non-IP bind address")
+	}
+	addr, err := parseBindAddress("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	conn, err := dialContext(newDialer(addr))(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if remote := (<-accepted).(*net.TCPAddr); !remote.IP.Equal(addr.IP) {
+		t.Errorf("Expected connection from %s, got %s", addr.IP, remote.IP)
+	}
+
+	// 192.0.2.1 is reserved for documentation and can't be bound to.
+	_, err = dialContext(newDialer(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))(context.Background(), "tcp", ln.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "192.0.2.1") {
+		t.Errorf("Expected bind error mentioning local address, got %v", err)
+	}
+}
+
+func TestDoScrapeSelfScrape(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	*metricsAddr = []string{"192.0.2.1:9369", ":9369"}
+	defer func() { *metricsAddr = nil }()
+
+	rewrite, err := parseURLRewrite(":9100/=:9369/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.urlRewrite = rewrite
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), http.DefaultClient)
+
+	resp := <-pushed
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if got := resp.Header.Get(errorTypeHeader); got != "scrape-loop" {
+		t.Errorf("Expected error type scrape-loop, got %q", got)
+	}
+}
+
+func TestDoScrapeDirectSelfScrape(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "client.example.com"
+	*metricsAddr = []string{":9369"}
+	defer func() { *metricsAddr = nil }()
+	target := &recordingTransport{urls: make(chan string, 1)}
+
+	// Monitoring the client itself through the proxy, e.g. behind NAT.
+	req := httptest.NewRequest("GET", "http://client.example.com:9369/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), &http.Client{Transport: target})
+	if got := <-target.urls; got != "http://client.example.com:9369/metrics" {
+		t.Errorf("Expected the client's own metrics to be scraped, got %s", got)
+	}
+	<-pushed
+}
+
+func TestIsMappedSelfScrape(t *testing.T) {
+	*myFqdn = "client.example.com"
+	defer func(v string) { *selfMetricsPath = v }(*selfMetricsPath)
+	listenAddrs := []string{":9369"}
+	for _, tc := range []struct {
+		target, mapped  string
+		selfMetricsPath string
+		expected        bool
+	}{
+		{"http://client.example.com:9369/metrics", "http://client.example.com:9369/metrics", "", false},
+		{"http://client.example.com:9100/metrics", "http://localhost:9100/metrics", "", false},
+		{"http://client.example.com:9100/metrics", "http://localhost:9369/metrics", "", true},
+		{"http://client.example.com:9100/metrics", "http://localhost:9369/metrics", "/metrics", false},
+		{"http://client.example.com:9100/-/quit", "http://localhost:9369/-/quit", "/metrics", true},
+	} {
+		*selfMetricsPath = tc.selfMetricsPath
+		target, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped, err := url.Parse(tc.mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isMappedSelfScrape(target, mapped, listenAddrs); got != tc.expected {
+			t.Errorf("isMappedSelfScrape(%s, %s) with --self-metrics-path=%q: expected %v, got %v", tc.target, tc.mapped, tc.selfMetricsPath, tc.expected, got)
+		}
+	}
+}
+
+func TestIsSelfScrape(t *testing.T) {
+	*myFqdn = "client.example.com"
+	for _, tc := range []struct {
+		url        string
+		listenAddr string
+		expected   bool
+	}{
+		{"http://localhost:9369/metrics", ":9369", true},
+		{"http://127.0.0.1:9369/metrics", ":9369", true},
+		{"http://client.example.com:9369/metrics", ":9369", true},
+		{"http://localhost:9100/metrics", ":9369", false},
+		{"http://other.example.com:9369/metrics", ":9369", false},
+		{"http://localhost:9369/metrics", "127.0.0.1:9369", true},
+		{"http://10.0.0.1:9369/metrics", "127.0.0.1:9369", false},
+		{"http://10.0.0.1:9369/metrics", "10.0.0.1:9369", true},
+		{"http://localhost/metrics", ":80", true},
+		{"http://localhost:9369/metrics", "", false},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isSelfScrape(u, tc.listenAddr); got != tc.expected {
+			t.Errorf("isSelfScrape(%s, %q): expected %v, got %v", tc.url, tc.listenAddr, tc.expected, got)
+		}
+	}
+}
+
+func TestSelfScrapeTargets(t *testing.T) {
+	defer func(localScrapeV, rewriteV, requireV string, ports []string) {
+		*localScrape, *scrapeURLRewrite, *requireTarget, *localScrapeAllowedPorts = localScrapeV, rewriteV, requireV, ports
+	}(*localScrape, *scrapeURLRewrite, *requireTarget, *localScrapeAllowedPorts)
+	*localScrape = "true"
+	*localScrapeAllowedPorts = []string{"9100", "9369"}
+	*scrapeURLRewrite = ".*=http://127.0.0.1:9101/metrics"
+	// Not mapped, so not a conflict.
+	*requireTarget = "127.0.0.1:9369"
+
+	got := selfScrapeTargets([]string{":9369"}, mappedScrapeTargets())
+	if len(got) != 1 || got[0] != "http://localhost:9369/" {
+		t.Errorf("Expected only the local scrape of port 9369 to conflict, got %v", got)
+	}
+	got = selfScrapeTargets([]string{"127.0.0.1:9101"}, mappedScrapeTargets())
+	if len(got) != 1 || got[0] != "http://127.0.0.1:9101/metrics" {
+		t.Errorf("Expected only the rewritten target to conflict, got %v", got)
+	}
+	if got = selfScrapeTargets([]string{":9200"}, mappedScrapeTargets()); len(got) != 0 {
+		t.Errorf("Expected no conflicts, got %v", got)
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := checkTarget(newDialer(nil), addr); err != nil {
+		t.Errorf("Expected listening target to be reachable, got %v", err)
+	}
+	ln.Close()
+	if err := checkTarget(newDialer(nil), addr); err == nil {
+		t.Error("Expected closed target to be unreachable")
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	var r recentIDs
+	if r.add("a") {
+		t.Error("Expected first id to be new")
+	}
+	if !r.add("a") {
+		t.Error("Expected repeated id to be seen")
+	}
+	for i := 0; i < recentScrapeIDsSize; i++ {
+		r.add(fmt.Sprint(i))
+	}
+	if r.add("a") {
+		t.Error("Expected id to be forgotten once the window moved on")
+	}
+	if len(r.ids) != recentScrapeIDsSize {
+		t.Errorf("Expected %d remembered ids, got %d", recentScrapeIDsSize, len(r.ids))
+	}
+
+	requests := testutil.ToFloat64(scrapeRequestsCounter)
+	unique := testutil.ToFloat64(uniqueScrapeIDsCounter)
+	r.observeScrapeRequest("b")
+	r.observeScrapeRequest("b")
+	if got := testutil.ToFloat64(scrapeRequestsCounter) - requests; got != 2 {
+		t.Errorf("Expected 2 scrape requests, got %f", got)
+	}
+	if got := testutil.ToFloat64(uniqueScrapeIDsCounter) - unique; got != 1 {
+		t.Errorf("Expected 1 unique scrape id, got %f", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Wed, 01 Jan 2020 00:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	} {
+		got, ok := parseRetryAfter(tc.header, now)
+		if got != tc.expected || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q): expected %s, %v, got %s, %v", tc.header, tc.expected, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestRetryAfterBackOff(t *testing.T) {
+	b := &retryAfterBackOff{BackOff: backoff.NewConstantBackOff(time.Second), max: time.Minute}
+	if next := b.NextBackOff(); next != time.Second {
+		t.Errorf("Expected generic backoff without Retry-After, got %s", next)
+	}
+	b.observe(errors.Wrap(&overloadError{status: "503", wait: 10 * time.Second}, "error polling"))
+	if next := b.NextBackOff(); next != 10*time.Second {
+		t.Errorf("Expected backoff of 10s from Retry-After, got %s", next)
+	}
+	b.observe(&overloadError{status: "429", wait: time.Hour})
+	if next := b.NextBackOff(); next != time.Minute {
+		t.Errorf("Expected Retry-After to be capped at 1m, got %s", next)
+	}
+	b.observe(errors.New("other error"))
+	if next := b.NextBackOff(); next != time.Second {
+		t.Errorf("Expected generic backoff after other errors, got %s", next)
+	}
+}
+
+func TestProtocolErrorBackOff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+
+	err := c.doPoll(ts.Client(), ts.Client())
+	if class := errorClass(err); class != "protocol" {
+		t.Fatalf("Expected protocol error, got %s: %v", class, err)
+	}
+	b := &retryAfterBackOff{BackOff: backoff.NewConstantBackOff(time.Second), max: 5 * time.Second, protocolWait: time.Minute}
+	b.observe(err)
+	if next := b.NextBackOff(); next != time.Minute {
+		t.Errorf("Expected protocol error wait of 1m, got %s", next)
+	}
+
+	ts.Close()
+	err = c.doPoll(ts.Client(), ts.Client())
+	if class := errorClass(err); class != "network" {
+		t.Errorf("Expected network error, got %s: %v", class, err)
+	}
+	b.observe(err)
+	if next := b.NextBackOff(); next != time.Second {
+		t.Errorf("Expected normal backoff after network error, got %s", next)
+	}
+}
+
+func TestSendPushRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+
+	err := c.sendPush(context.Background(), ts.Client(), nil)
+	var overloadErr *overloadError
+	if !errors.As(err, &overloadErr) {
+		t.Fatalf("Expected overload error, got %v", err)
+	}
+	if overloadErr.wait != 7*time.Second {
+		t.Errorf("Expected to be asked to wait 7s, got %s", overloadErr.wait)
+	}
+}
+
+func TestSendPushConnectionClose(t *testing.T) {
+	closes := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closes <- r.Close
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pushPath = "push"
+	defer func() { *pushConnectionClose = false }()
+
+	for _, connectionClose := range []bool{false, true} {
+		*pushConnectionClose = connectionClose
+		if err := c.sendPush(context.Background(), ts.Client(), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-closes; got != connectionClose {
+			t.Errorf("Expected Connection: close to be %t, got %t", connectionClose, got)
+		}
+	}
+}
+
+func TestDoPollRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+
+	err := c.doPoll(ts.Client(), ts.Client())
+	var overloadErr *overloadError
+	if !errors.As(err, &overloadErr) {
+		t.Fatalf("Expected overload error, got %v", err)
+	}
+	if overloadErr.wait < 55*time.Second || overloadErr.wait > time.Minute {
+		t.Errorf("Expected to be asked to wait about 1m, got %s", overloadErr.wait)
+	}
+}
+
+func TestScrapeTLSServerName(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer ts.Close()
+	tlsConfig := &tls.Config{RootCAs: ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	defer func() { *scrapeServerName = "" }()
+
+	// The test server certificate is valid for example.com, and is scraped
+	// by IP.
+	for _, tc := range []struct {
+		serverName string
+		ok         bool
+	}{
+		{"example.com", true},
+		{"example.org", false},
+	} {
+		*scrapeServerName = tc.serverName
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: scrapeTLSConfig(tlsConfig)}}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("Expected success %v scraping with server name %s, got %v", tc.ok, tc.serverName, err)
+		}
+	}
+	if tlsConfig.ServerName != "" {
+		t.Errorf("Expected shared TLS config to be unchanged, got server name %q", tlsConfig.ServerName)
+	}
+}
+
+func TestConnectDialer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+	tunnel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			http.Error(w, "bad credentials", http.StatusProxyAuthRequired)
+			return
+		}
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(targetConn, conn)
+			targetConn.Close()
+		}()
+		io.Copy(conn, targetConn)
+		conn.Close()
+	}))
+	defer tunnel.Close()
+	tunnelAddr := strings.TrimPrefix(tunnel.URL, "http://")
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: newConnectDialer(&TestLogger{}, dialContext(newDialer(nil)), "http://user:pass@"+tunnelAddr, 1, 0),
+	}}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "up 1\n" {
+		t.Errorf("Expected target response through the tunnel, got %q", body)
+	}
+
+	client = &http.Client{Transport: &http.Transport{
+		DialContext: newConnectDialer(&TestLogger{}, dialContext(newDialer(nil)), "user:wrong@"+tunnelAddr, 1, 0),
+	}}
+	if _, err := client.Get(target.URL); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected proxy authentication error, got %v", err)
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	hasMetric := func(r *prometheus.Registry, name string) bool {
+		mfs, err := r.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				return true
+			}
+		}
+		return false
+	}
+	if hasMetric(registry, "go_goroutines") {
+		t.Error("Expected no runtime metrics unless registered")
+	}
+	if !hasMetric(registry, "pushprox_client_scrapes_in_flight") {
+		t.Error("Expected client metrics to be registered")
+	}
+	r := prometheus.NewRegistry()
+	registerRuntimeCollectors(r)
+	if !hasMetric(r, "go_goroutines") || !hasMetric(r, "process_start_time_seconds") {
+		t.Error("Expected runtime metrics once registered")
+	}
+}
+
+func TestProxyAuthenticators(t *testing.T) {
+	newReq := func() *http.Request {
+		return httptest.NewRequest("POST", "http://proxy/push", strings.NewReader("body"))
+	}
+
+	req := newReq()
+	if err := (noAuth{}).Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("Expected no headers without authentication, got %v", req.Header)
+	}
+
+	req = newReq()
+	if err := (basicAuth{username: "user", password: "pass"}).Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Errorf("Expected basic auth user:pass, got %s:%s", user, pass)
+	}
+
+	req = newReq()
+	if err := (bearerAuth{token: "token"}).Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Expected bearer token, got %q", got)
+	}
+
+	req = newReq()
+	auth := hmacAuth{secret: []byte("secret"), now: func() time.Time { return time.Unix(1600000000, 0) }}
+	if err := auth.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	fmt.Fprintf(mac, "1600000000\nPOST\n/push\n%x\n", sha256.Sum256([]byte("body")))
+	if got, expected := req.Header.Get(signatureHeader), "t=1600000000,sig="+hex.EncodeToString(mac.Sum(nil)); got != expected {
+		t.Errorf("Expected signature %q, got %q", expected, got)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "body" {
+		t.Errorf("Expected body to be preserved after signing, got %q", body)
+	}
+}
+
+func TestNewProxyAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentials := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		authType, file string
+		expected       ProxyAuthenticator
+	}{
+		{"", "", noAuth{}},
+		{"none", "", noAuth{}},
+		{"basic", credentials, basicAuth{username: "user", password: "secret"}},
+		{"bearer", credentials, bearerAuth{token: "secret"}},
+	} {
+		auth, err := newProxyAuthenticator(tc.authType, "user", tc.file)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.authType, err)
+		} else if auth != tc.expected {
+			t.Errorf("Expected %#v for %q, got %#v", tc.expected, tc.authType, auth)
+		}
+	}
+	if auth, err := newProxyAuthenticator("hmac", "", credentials); err != nil || string(auth.(hmacAuth).secret) != "secret" {
+		t.Errorf("Expected hmac authenticator with secret, got %#v, %v", auth, err)
+	}
+	if _, err := newProxyAuthenticator("bearer", "", ""); err == nil {
+		t.Error("Expected error without credentials file")
+	}
+	if _, err := newProxyAuthenticator("bearer", "", filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected error for missing credentials file")
+	}
+}
+
+func TestDoPollAuthenticates(t *testing.T) {
+	authorization := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}, authenticator: bearerAuth{token: "token"}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-authorization; got != "Bearer token" {
+		t.Errorf("Expected poll to be authenticated, got %q", got)
+	}
+}
+
+func TestScrapeResponseStatusCounter(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	before := testutil.ToFloat64(scrapeResponseStatusCounter.WithLabelValues("5xx"))
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+	<-pushed
+	if got := testutil.ToFloat64(scrapeResponseStatusCounter.WithLabelValues("5xx")) - before; got != 1 {
+		t.Errorf("Expected one 5xx response to be counted, got %f", got)
+	}
+
+	for code, expected := range map[int]string{200: "2xx", 404: "4xx", 0: "other", 999: "other"} {
+		if got := statusClass(code); got != expected {
+			t.Errorf("Expected class %s for %d, got %s", expected, code, got)
+		}
+	}
+}
+
+func TestScrapeForwardHeaders(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	headers := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer target.Close()
+	*scrapeForwardHeaders = []string{"x-allowed"}
+	defer func() { *scrapeForwardHeaders = nil }()
+
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Set("id", "scrape-id")
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	req.Header.Set("X-Allowed", "yes")
+	req.Header.Set("Authorization", "Bearer injected")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	got := <-headers
+	for name, expected := range map[string]string{
+		"Accept":                              "text/plain",
+		"X-Prometheus-Scrape-Timeout-Seconds": "10.0",
+		"X-Allowed":                           "yes",
+		"Authorization":                       "",
+		"Id":                                  "",
+	} {
+		if got.Get(name) != expected {
+			t.Errorf("Expected %s header %q, got %q", name, expected, got.Get(name))
+		}
+	}
+	if id := (<-pushed).Header.Get("id"); id != "scrape-id" {
+		t.Errorf("Expected pushed response for scrape-id, got %q", id)
+	}
+}
+
+func TestScrapeMaxForwardHeaders(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	headers := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer target.Close()
+	*scrapeMaxForwardHeaders = 10
+	defer func() { *scrapeMaxForwardHeaders = 0 }()
+
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	for i := 0; i < 10000; i++ {
+		req.Header.Set(fmt.Sprintf("X-Junk-%05d", i), "junk")
+	}
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	got := <-headers
+	junk := 0
+	for name := range got {
+		if strings.HasPrefix(name, "X-Junk-") {
+			junk++
+		}
+	}
+	if junk != 8 {
+		t.Errorf("Expected 8 junk headers to be forwarded, got %d", junk)
+	}
+	if got.Get("Accept") != "text/plain" || got.Get("X-Prometheus-Scrape-Timeout-Seconds") != "10.0" {
+		t.Errorf("Expected Accept and timeout headers to be forwarded, got %v", got)
+	}
+	if got.Get("X-Junk-00000") == "" || got.Get("X-Junk-09999") != "" {
+		t.Errorf("Expected the first junk headers by name to be forwarded, got %v", got)
+	}
+	if resp := <-pushed; resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected pushed status 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyHTTPTransportCredentials(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+	plainTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer plainTarget.Close()
+	forwardProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			http.Error(w, "bad credentials", http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(targetConn, conn)
+			targetConn.Close()
+		}()
+		io.Copy(conn, targetConn)
+		conn.Close()
+	}))
+	defer forwardProxy.Close()
+	forwardProxyAddr := strings.TrimPrefix(forwardProxy.URL, "http://")
+	tlsConfig := target.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, tc := range []struct {
+		name, proxyURL, targetURL string
+		ok                        bool
+	}{
+		{"CONNECT with credentials", "http://user:pass@" + forwardProxyAddr, target.URL, true},
+		{"CONNECT without credentials", "http://" + forwardProxyAddr, target.URL, false},
+		{"HTTP with credentials", "http://user:pass@" + forwardProxyAddr, plainTarget.URL, true},
+		{"HTTP without credentials", "http://" + forwardProxyAddr, plainTarget.URL, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyURL, err := url.Parse(tc.proxyURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: newProxyHTTPTransport(http.ProxyURL(proxyURL), dialContext(newDialer(nil)), tlsConfig)}
+			resp, err := client.Get(tc.targetURL)
+			if !tc.ok {
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusProxyAuthRequired {
+						t.Errorf("Expected 407 without credentials, got %d", resp.StatusCode)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "up 1\n" {
+				t.Errorf("Expected target response through the forward proxy, got %q", body)
+			}
+		})
+	}
+}
+
+func TestPushMetadataHeaders(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	scrape := func() *http.Response {
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+		return <-pushed
+	}
+
+	if resp := scrape(); resp.Header.Get("X-PushProx-Scrape-Bytes") != "" || resp.Header.Get("X-PushProx-Scrape-Duration-Seconds") != "" {
+		t.Errorf("Expected no metadata headers by default, got %v", resp.Header)
+	}
+
+	*pushMetadataHeaders = true
+	defer func() { *pushMetadataHeaders = false }()
+	resp := scrape()
+	if got := resp.Header.Get("X-PushProx-Scrape-Bytes"); got != "5" {
+		t.Errorf("Expected X-PushProx-Scrape-Bytes 5, got %q", got)
+	}
+	duration, err := strconv.ParseFloat(resp.Header.Get("X-PushProx-Scrape-Duration-Seconds"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration < 0.02 {
+		t.Errorf("Expected a scrape duration of at least 20ms, got %fs", duration)
+	}
+}
+
+func TestScrapeTruncatedResponse(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "up 1\n"
+		if r.URL.Path == "/truncated" {
+			// Promise twice the body, then close the connection.
+			w.Header().Set("Content-Length", strconv.Itoa(2*len(body)))
+		}
+		io.WriteString(w, body)
+	}))
+	defer target.Close()
+
+	for path, expected := range map[string]int{"/truncated": http.StatusBadGateway, "/metrics": http.StatusOK} {
+		req := httptest.NewRequest("GET", target.URL+path, nil)
+		req.RequestURI = ""
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+
+		resp := <-pushed
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %d for %s, got %d", expected, path, resp.StatusCode)
+		}
+		if expected == http.StatusBadGateway && resp.Header.Get(errorTypeHeader) != "truncated" {
+			t.Errorf("Expected error type truncated, got %q", resp.Header.Get(errorTypeHeader))
+		}
+	}
+}
+
+func TestScrapeTimeouts(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	for _, tc := range []struct {
+		target   *httptest.Server
+		timeouts float64
+	}{
+		{slow, 1},
+		{refused, 0},
+	} {
+		host := strings.TrimPrefix(tc.target.URL, "http://")
+		before := testutil.ToFloat64(scrapeTimeoutsCounter.WithLabelValues(host))
+		req := httptest.NewRequest("GET", tc.target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.1")
+		c.doScrape(req, proxy.Client(), &http.Client{})
+
+		if got := testutil.ToFloat64(scrapeTimeoutsCounter.WithLabelValues(host)) - before; got != tc.timeouts {
+			t.Errorf("Expected %f timeouts for %s, got %f", tc.timeouts, tc.target.URL, got)
+		}
+		// There is no time left to push the error of the timed out scrape.
+		if tc.timeouts == 0 {
+			if resp := <-pushed; resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("Expected status 500 for %s, got %d", tc.target.URL, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestProxyTLSPins(t *testing.T) {
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer proxy.Close()
+	tlsConfig := proxy.Client().Transport.(*http.Transport).TLSClientConfig
+	fingerprint := sha256.Sum256(proxy.Certificate().Raw)
+	other := sha256.Sum256([]byte("other certificate"))
+
+	for _, tc := range []struct {
+		pins []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{hex.EncodeToString(fingerprint[:])}, true},
+		{[]string{hex.EncodeToString(other[:]), strings.ToUpper(hex.EncodeToString(fingerprint[:]))}, true},
+		{[]string{hex.EncodeToString(other[:])}, false},
+	} {
+		pins, err := parseCertPins(tc.pins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: proxyTLSConfig(tlsConfig, pins)}}
+		resp, err := client.Get(proxy.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("Expected success %t with pins %v, got %v", tc.ok, tc.pins, err)
+		}
+	}
+
+	for _, invalid := range []string{"not hex", "ab:cd"} {
+		if _, err := parseCertPins([]string{invalid}); err == nil {
+			t.Errorf("Expected pin %q to be rejected", invalid)
+		}
+	}
+	var withColons []string
+	for _, b := range fingerprint {
+		withColons = append(withColons, fmt.Sprintf("%02X", b))
+	}
+	pins, err := parseCertPins([]string{strings.Join(withColons, ":")})
+	if err != nil || !bytes.Equal(pins[0], fingerprint[:]) {
+		t.Errorf("Expected openssl style fingerprint to be parsed, got %x, %v", pins, err)
+	}
+}
+
+func TestConnectDialerRetry(t *testing.T) {
+	attempts := 0
+	tunnel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		conn.Close()
+	}))
+	defer tunnel.Close()
+	tunnelAddr := strings.TrimPrefix(tunnel.URL, "http://")
+
+	before := testutil.ToFloat64(connectErrorCounter)
+	dial := newConnectDialer(&TestLogger{}, dialContext(newDialer(nil)), tunnelAddr, 2, time.Millisecond)
+	if _, err := dial(context.Background(), "tcp", "target:80"); err == nil {
+		t.Fatal("Expected CONNECT to fail after 2 attempts")
+	}
+	dial = newConnectDialer(&TestLogger{}, dialContext(newDialer(nil)), tunnelAddr, 2, time.Millisecond)
+	conn, err := dial(context.Background(), "tcp", "target:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if attempts != 3 {
+		t.Errorf("Expected 3 CONNECT attempts, got %d", attempts)
+	}
+	if got := testutil.ToFloat64(connectErrorCounter) - before; got != 2 {
+		t.Errorf("Expected 2 connect errors, got %f", got)
+	}
+}
+
+func TestPushToPollSource(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to the new proxy: %s", r.URL)
+	}))
+	defer other.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	pushed := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/push" {
+			pushed <- r.URL.Path
+			return
+		}
+		// The proxy URL is reloaded while the scrape is in flight.
+		c.setProxyURL(other.URL)
+		fmt.Fprint(w, "GET http://127.0.0.1:1/metrics HTTP/1.1\r\nHost: 127.0.0.1:1\r\nX-Prometheus-Scrape-Timeout-Seconds: 10\r\n\r\n")
+	}))
+	defer ts.Close()
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+	*pushPath = "push"
+	*myFqdn = "127.0.0.1"
+
+	target := &recordingTransport{urls: make(chan string, 1)}
+	if err := c.doPoll(ts.Client(), &http.Client{Transport: target}); err != nil {
+		t.Fatal(err)
+	}
+	<-target.urls
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected response to be pushed to the proxy it was polled from")
+	}
+}
+
+func TestWithNetwork(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dial := dialContext(newDialer(nil))
+
+	conn, err := withNetwork(dial, "tcp4")(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected tcp4 to reach an IPv4 address, got %v", err)
+	}
+	conn.Close()
+	if _, err := withNetwork(dial, "tcp6")(context.Background(), "tcp", ln.Addr().String()); err == nil {
+		t.Error("Expected tcp6 not to reach an IPv4 address")
+	}
+}
+
+func TestWithNoDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	defer ln.Close()
+
+	for _, noDelay := range []bool{true, false} {
+		conn, err := withNoDelay(newDialer(nil).DialContext, noDelay)(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Unexpected error with nodelay %v: %v", noDelay, err)
+		}
+		if _, ok := conn.(*net.TCPConn); !ok {
+			t.Errorf("Expected a TCP connection, got %T", conn)
+		}
+		conn.Close()
+	}
+
+	dialErr := errors.New("dial failed")
+	failing := func(context.Context, string, string) (net.Conn, error) { return nil, dialErr }
+	if _, err := withNoDelay(failing, true)(context.Background(), "tcp", addr); err != dialErr {
+		t.Errorf("Expected dial error to be passed through, got %v", err)
+	}
+}
+
+func TestScrapeWarnBodyBytes(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	*scrapeWarnBodyBytes = 10
+	defer func() { *scrapeWarnBodyBytes = 0 }()
+	body := strings.Repeat("x", 20)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer target.Close()
+	host := strings.TrimPrefix(target.URL, "http://")
+
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	resp := <-pushed
+	if got, _ := ioutil.ReadAll(resp.Body); string(got) != body {
+		t.Errorf("Expected the full body to be pushed, got %q", got)
+	}
+	if got := testutil.ToFloat64(largeScrapeCounter.WithLabelValues(host)); got != 1 {
+		t.Errorf("Expected one large scrape of %s, got %f", host, got)
+	}
+}
+
+func TestResolveFQDN(t *testing.T) {
+	defer func() { *myFqdn, *fqdnDisableLookup = "", false }()
+	lookups := 0
+	lookup := func() string {
+		lookups++
+		return "looked-up.example.com"
+	}
+
+	*myFqdn = "flag.example.com"
+	if err := resolveFQDN(&TestLogger{}, lookup); err != nil || *myFqdn != "flag.example.com" {
+		t.Errorf("Expected FQDN from flag, got %q, %v", *myFqdn, err)
+	}
+	if lookups != 0 {
+		t.Error("Expected no lookup when the FQDN is set")
+	}
+
+	*myFqdn = ""
+	if err := resolveFQDN(&TestLogger{}, lookup); err != nil || *myFqdn != "looked-up.example.com" {
+		t.Errorf("Expected looked up FQDN, got %q, %v", *myFqdn, err)
+	}
+
+	*myFqdn = ""
+	*fqdnDisableLookup = true
+	if err := resolveFQDN(&TestLogger{}, lookup); err == nil {
+		t.Error("Expected error without FQDN when lookups are disabled")
+	}
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, got %d", lookups)
+	}
+}
+
+func TestRandomDelay(t *testing.T) {
+	if d := randomDelay(0); d != 0 {
+		t.Errorf("Expected no delay without jitter, got %s", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := randomDelay(time.Second); d < 0 || d >= time.Second {
+			t.Fatalf("Expected delay in [0, 1s), got %s", d)
+		}
+	}
+}
+
+func TestWithDialBudget(t *testing.T) {
+	var budget time.Duration
+	slow := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		deadline, _ := ctx.Deadline()
+		budget = time.Until(deadline)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := withDialBudget(slow, 0.1, nil)(ctx, "tcp", "target:80")
+	if err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("Expected dial budget error, got %v", err)
+	}
+	if budget > 100*time.Millisecond {
+		t.Errorf("Expected dial budget of at most 100ms, got %s", budget)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected the scrape deadline not to be used up by the dial")
+	}
+}
+
+func TestDialBudgetCoversTLSHandshake(t *testing.T) {
+	defer func(v float64) { *scrapeDialBudgetFraction = v }(*scrapeDialBudgetFraction)
+	*scrapeDialBudgetFraction = 0.1
+	// Accepts connections but never answers the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := &http.Client{Transport: newScrapeTargetTransport(dialContext(&net.Dialer{}), nil)}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(withScrapeDeadline(ctx), "GET", "https://"+ln.Addr().String()+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = client.Do(req)
+	if err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("Expected the stalled TLS handshake to exceed the dial budget, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the handshake to be cut off after about 200ms, took %s", elapsed)
+	}
+}
+
+func TestObserveFeatures(t *testing.T) {
+	defer func(bufferSize int, compression string, acceptGzip bool) {
+		*pushBufferSize, *pushCompression, *scrapeAcceptGzip = bufferSize, compression, acceptGzip
+	}(*pushBufferSize, *pushCompression, *scrapeAcceptGzip)
+	*pushBufferSize = 10
+	*pushCompression = "auto"
+	*scrapeAcceptGzip = true
+	c := &Coordinator{logger: &TestLogger{}}
+	observeFeatures(c.enabledFeatures())
+	for feature, expected := range map[string]float64{"push_buffer": 1, "proxy_connect": 0, "scrape_accept_gzip": 1, "push_compression": 0} {
+		if got := testutil.ToFloat64(featureEnabledGauge.WithLabelValues(feature)); got != expected {
+			t.Errorf("Expected feature %s to be %f, got %f", feature, expected, got)
+		}
+	}
+
+	// Negotiating the capability with the proxy enables compression.
+	c.setCapabilities(util.Capabilities{util.PushGzipCapability: true})
+	if got := testutil.ToFloat64(featureEnabledGauge.WithLabelValues("push_compression")); got != 1 {
+		t.Errorf("Expected push_compression to be enabled after negotiation, got %f", got)
+	}
+	c.setCapabilities(util.Capabilities{})
+	if got := testutil.ToFloat64(featureEnabledGauge.WithLabelValues("push_compression")); got != 0 {
+		t.Errorf("Expected push_compression to be disabled by a proxy without the capability, got %f", got)
+	}
+}
+
+func TestPushDumper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	c.pushDumper = &pushDumper{dir: dir, maxBytes: 1 << 20, maxFiles: 2}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "http://target/metrics", nil)
+		req.Header.Set("id", fmt.Sprintf("scrape/%d", i))
+		resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n")), ContentLength: 5}
+		if err := c.doPush(resp, req, proxy.Client()); err != nil {
+			t.Fatal(err)
+		}
+		<-pushed
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+dumpFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 dumps to be kept, got %v", files)
+	}
+	if !strings.HasSuffix(files[1], "scrape_2"+dumpFileSuffix) {
+		t.Errorf("Expected newest dump to be of scrape/2, got %s", files[1])
+	}
+	dumped, err := ioutil.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dumped, []byte("up 1\n")) || !bytes.Contains(dumped, []byte("Id: scrape/2")) {
+		t.Errorf("Expected dump to hold the pushed response, got %q", dumped)
+	}
+
+	d := &pushDumper{dir: dir, maxBytes: 4}
+	if err := d.dump("truncated", []byte("0123456789"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*truncated"+dumpFileSuffix))
+	if len(files) != 1 {
+		t.Fatalf("Expected truncated dump, got %v", files)
+	}
+	if dumped, _ := ioutil.ReadFile(files[0]); string(dumped) != "0123" {
+		t.Errorf("Expected dump truncated to 4 bytes, got %q", dumped)
+	}
+}
+
+func TestPushGate(t *testing.T) {
+	var nilGate *pushGate
+	nilGate.record(errors.New("push failed"), time.Now())
+	if err := nilGate.wait(context.Background()); err != nil {
+		t.Errorf("Expected disabled gate to never delay, got %v", err)
+	}
+
+	g := &pushGate{initial: 100 * time.Millisecond, max: time.Second}
+	now := time.Now()
+	for i, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		g.record(errors.New("push failed"), now)
+		if got := g.closedUntil.Sub(now); got != expected {
+			t.Errorf("Expected delay %s after %d failures, got %s", expected, i+1, got)
+		}
+	}
+	if got := testutil.ToFloat64(pushGateOpenGauge); got != 0 {
+		t.Errorf("Expected gate to be closed, got %f", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected wait to stop at the deadline, got %v", err)
+	}
+
+	g.record(nil, time.Now())
+	if err := g.wait(context.Background()); err != nil {
+		t.Errorf("Expected open gate not to delay, got %v", err)
+	}
+	if got := testutil.ToFloat64(pushGateOpenGauge); got != 1 {
+		t.Errorf("Expected gate to be open, got %f", got)
+	}
+}
+
+func TestAddLabels(t *testing.T) {
+	body := []byte(`# HELP up Whether the target is up.
+# TYPE up gauge
+up 1
+up{node="other"} 0
+# TYPE requests_total counter
+requests_total{code="200"} 3
+`)
+	labeled, err := addLabels(body, map[string]string{"node": "client.example.com", "env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE requests_total counter
+requests_total{code="200",env="prod",node="client.example.com"} 3
+# HELP up Whether the target is up.
+# TYPE up gauge
+up{env="prod",node="client.example.com"} 1
+up{node="other",env="prod"} 0
+`
+	if string(labeled) != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, labeled)
+	}
+
+	if _, err := addLabels([]byte("not metrics {"), map[string]string{"node": "x"}); err == nil {
+		t.Error("Expected error for unparseable body")
+	}
+	if err := validateLabelName("0invalid"); err == nil {
+		t.Error("Expected error for invalid label name")
+	}
+	for contentType, expected := range map[string]bool{
+		"":                          true,
+		"text/plain; version=0.0.4": true,
+		"application/openmetrics-text; version=1.0.0; charset=utf-8": false,
+	} {
+		if got := isTextFormat(http.Header{"Content-Type": {contentType}}); got != expected {
+			t.Errorf("Expected isTextFormat(%q) to be %v, got %v", contentType, expected, got)
+		}
+	}
+}
+
+// upperTransformer upper-cases bodies, to check the order of transformers.
+type upperTransformer struct{}
+
+func (upperTransformer) Transform(header http.Header, body io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(bytes.ToUpper(b)), nil
+}
+
+func TestTransformBody(t *testing.T) {
+	label := labelTransformer{logger: &TestLogger{}, labels: map[string]string{"node": "client"}}
+	body := []byte("up 1\n")
+
+	got, err := transformBody([]BodyTransformer{label, upperTransformer{}}, http.Header{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE UP UNTYPED\nUP{NODE=\"CLIENT\"} 1\n"; string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	// The label is added after upper-casing, so it keeps its case.
+	got, err = transformBody([]BodyTransformer{upperTransformer{}, label, validateTransformer{}}, http.Header{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE UP untyped\nUP{node=\"client\"} 1\n"; string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	if _, err := transformBody([]BodyTransformer{label, validateTransformer{}}, http.Header{}, []byte("not metrics {")); err == nil {
+		t.Error("Expected invalid body to fail validation after the label transformer passed it on")
+	}
+	protobuf := "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	if got, err := transformBody([]BodyTransformer{label, validateTransformer{}}, http.Header{"Content-Type": {protobuf}}, []byte("binary")); err != nil || string(got) != "binary" {
+		t.Errorf("Expected non-text bodies to be passed on unchanged, got %q (err: %v)", got, err)
+	}
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(body)
+	gz.Close()
+	header := http.Header{"Content-Encoding": {"gzip"}}
+	got, err = transformBody([]BodyTransformer{decompressTransformer{}, label}, header, gzipped.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE up untyped\nup{node=\"client\"} 1\n"; string(got) != expected {
+		t.Errorf("Expected the label to be added to the decompressed body %q, got %q", expected, got)
+	}
+	if enc := header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected Content-Encoding to be removed after decompressing, got %q", enc)
+	}
+	if _, err := transformBody([]BodyTransformer{decompressTransformer{}}, http.Header{"Content-Encoding": {"gzip"}}, body); err == nil {
+		t.Error("Expected a body that isn't gzip to fail decompression")
+	}
+}
+
+func TestNewBodyTransformers(t *testing.T) {
+	if _, err := newBodyTransformers(&TestLogger{}, []string{"add-fqdn-label"}); err == nil {
+		t.Error("Expected add-fqdn-label to require --scrape.add-fqdn-label")
+	}
+	*scrapeAddFQDNLabel = "node"
+	defer func() { *scrapeAddFQDNLabel = "" }()
+	transformers, err := newBodyTransformers(&TestLogger{}, []string{"validate", "add-fqdn-label"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transformers[0].(validateTransformer); !ok || len(transformers) != 2 {
+		t.Errorf("Expected transformers in the given order, got %v", transformers)
+	}
+}
+
+func TestDoPollMaxResponseBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "GET /index.html HTTP/1.0\nX-Padding: %s\n\n", strings.Repeat("x", 1000))
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+	defer func(v int64) { *maxPollResponseBytes = v }(*maxPollResponseBytes)
+	*maxPollResponseBytes = 100
+
+	before := testutil.ToFloat64(pollErrorCounter)
+	err := c.doPoll(ts.Client(), ts.Client())
+	c.recordPollResult(err)
+	if err == nil || !strings.Contains(err.Error(), "exceeds 100 bytes") {
+		t.Errorf("Expected poll response size error, got %v", err)
+	}
+	if got := testutil.ToFloat64(pollErrorCounter) - before; got != 1 {
+		t.Errorf("Expected poll error to be counted once, got %f", got)
+	}
+
+	*maxPollResponseBytes = 2000
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Errorf("Expected poll response within the limit to be accepted, got %v", err)
+	}
+}
+
+func TestParseStaticHeaders(t *testing.T) {
+	h, err := parseStaticHeaders([]string{"x-tenant=team-a", "X-Route=a=b", "X-Route=c", "X-Empty=", "id=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := http.Header{"X-Tenant": {"team-a"}, "X-Route": {"a=b", "c"}, "X-Empty": {""}, "Id": {"1"}}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("Expected headers %v, got %v", expected, h)
+	}
+
+	for _, invalid := range []string{"X-Tenant", "=value", "Bad Name=value", "X-Tenant=a\r\nX-Injected: b", "content-type=text/plain", "Content-Type=application/json"} {
+		if _, err := parseStaticHeaders([]string{invalid}); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestProxyRequestHeaders(t *testing.T) {
+	pollHeaders := make(chan http.Header, 1)
+	pushHeaders := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/poll" {
+			pollHeaders <- r.Header
+			io.WriteString(w, "GET http://unknown-host/metrics HTTP/1.1\nid: 1\nX-Prometheus-Scrape-Timeout-Seconds: 1\n\n")
+			return
+		}
+		pushHeaders <- r.Header
+	}))
+	defer ts.Close()
+	*myFqdn = "127.0.0.1"
+	*pollPath = "poll"
+	*pushPath = "push"
+	*pollContentType = "text/plain"
+	defer func() { *pollContentType = "" }()
+	c := &Coordinator{
+		logger:      &TestLogger{},
+		pollHeaders: http.Header{"X-Tenant": {"team-a"}},
+		pushHeaders: http.Header{"X-Tenant": {"team-a"}, "X-Route": {"push"}},
+	}
+	c.setProxyURL(ts.URL)
+
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	poll := <-pollHeaders
+	if poll.Get("X-Tenant") != "team-a" || poll.Get("X-Route") != "" {
+		t.Errorf("Expected only --proxy.header on polls, got %v", poll)
+	}
+	if got := poll.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Expected poll content type text/plain, got %q", got)
+	}
+	// The scrape fails on the FQDN check and its error is pushed.
+	push := <-pushHeaders
+	if push.Get("X-Tenant") != "team-a" || push.Get("X-Route") != "push" {
+		t.Errorf("Expected --proxy.header and --push.header on pushes, got %v", push)
+	}
+	if got := push.Get("Content-Type"); got != "message/http" {
+		t.Errorf("Expected push content type message/http, got %q", got)
+	}
+}
+
+func TestPollFloor(t *testing.T) {
+	f := &pollFloor{step: time.Second, max: 5 * time.Second}
+	failed := errors.New("proxy error")
+	for i, tc := range []struct {
+		err      error
+		expected time.Duration
+	}{
+		{nil, 0},
+		{failed, time.Second},
+		{failed, 2 * time.Second},
+		{failed, 4 * time.Second},
+		{failed, 5 * time.Second},
+		{nil, 2500 * time.Millisecond},
+		{failed, 5 * time.Second},
+		{nil, 2500 * time.Millisecond},
+		{nil, 1250 * time.Millisecond},
+		{nil, 0},
+	} {
+		if got := f.observe(tc.err); got != tc.expected {
+			t.Errorf("Expected floor %s after poll %d, got %s", tc.expected, i, got)
+		}
+	}
+	if got := testutil.ToFloat64(pollFloorGauge); got != 0 {
+		t.Errorf("Expected floor gauge 0, got %f", got)
+	}
+}
+
+func TestDoPollResponseMetrics(t *testing.T) {
+	pollRequest := "GET /index.html HTTP/1.0\nX-Padding: " + strings.Repeat("x", 1000) + "\n\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like a proxy holding the poll until it has a scrape.
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, pollRequest)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: &TestLogger{}}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+
+	var before, rttBefore dto.Metric
+	if err := pollResponseBytesHistogram.Write(&before); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollRTTHistogram.Write(&rttBefore); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	var bytesMetric, durationMetric dto.Metric
+	if err := pollResponseBytesHistogram.Write(&bytesMetric); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollParseDurationHistogram.Write(&durationMetric); err != nil {
+		t.Fatal(err)
+	}
+	if got := bytesMetric.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); got != float64(len(pollRequest)) {
+		t.Errorf("Expected %d poll response bytes to be observed, got %f", len(pollRequest), got)
+	}
+	if durationMetric.GetHistogram().GetSampleCount() == 0 {
+		t.Error("Expected poll parse duration to be observed")
+	}
+	var rttMetric dto.Metric
+	if err := pollRTTHistogram.Write(&rttMetric); err != nil {
+		t.Fatal(err)
+	}
+	if got := rttMetric.GetHistogram().GetSampleSum() - rttBefore.GetHistogram().GetSampleSum(); got < 0.05 {
+		t.Errorf("Expected a poll round trip of at least 50ms to be observed, got %fs", got)
+	}
+}
+
+func TestClientRequestID(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	*addClientRequestID = true
+	defer func() { *addClientRequestID = false }()
+	scraped := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scraped <- r.Header.Get(clientRequestIDHeader)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Set("id", "scrape-id")
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target.Client())
+
+	scrapeID := <-scraped
+	if _, err := uuid.Parse(scrapeID); err != nil {
+		t.Errorf("Expected a UUID as client request id, got %q: %v", scrapeID, err)
+	}
+	resp := <-pushed
+	if got := resp.Header.Get(clientRequestIDHeader); got != scrapeID {
+		t.Errorf("Expected push with client request id %q, got %q", scrapeID, got)
+	}
+	if got := resp.Header.Get("id"); got != "scrape-id" {
+		t.Errorf("Expected push to keep the proxy's id, got %q", got)
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	s := &logSampler{n: 2, interval: time.Minute}
+	start := time.Now()
+	errRefused := errors.New("connection refused")
+	for i, want := range []struct {
+		offset     time.Duration
+		err        error
+		log        bool
+		suppressed int
+	}{
+		{0, errRefused, true, 0},
+		{time.Second, errRefused, true, 0},
+		{2 * time.Second, errRefused, false, 0},
+		{3 * time.Second, errRefused, false, 0},
+		{61 * time.Second, errRefused, true, 2},
+		{62 * time.Second, errRefused, false, 0},
+		{63 * time.Second, errors.New("timeout"), true, 1},
+	} {
+		log, suppressed := s.sample(want.err, start.Add(want.offset))
+		if log != want.log || suppressed != want.suppressed {
+			t.Errorf("%d: expected (%t, %d), got (%t, %d)", i, want.log, want.suppressed, log, suppressed)
+		}
+	}
+	s.sample(errRefused, start.Add(64*time.Second))
+	s.sample(errRefused, start.Add(65*time.Second))
+	s.sample(errRefused, start.Add(66*time.Second))
+	if got := s.reset(); got != 1 {
+		t.Errorf("Expected 1 suppressed error on reset, got %d", got)
+	}
+	if log, _ := s.sample(errRefused, start.Add(67*time.Second)); !log {
+		t.Error("Expected errors to be logged again after a reset")
+	}
+
+	all := &logSampler{interval: time.Minute}
+	for i := 0; i < 5; i++ {
+		if log, _ := all.sample(errRefused, start); !log {
+			t.Errorf("%d: expected every error to be logged without a limit", i)
+		}
+	}
+}
+
+func TestScrapeDisableExpectContinue(t *testing.T) {
+	// The Go server drops the Expect header, so read the requests raw.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer func() { *scrapeDisableExpectContinue = false }()
+	expects := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				expects <- req.Header.Get("Expect")
+				if req.Header.Get("Expect") != "" {
+					io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+				}
+				io.Copy(ioutil.Discard, req.Body)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+
+	for _, disable := range []bool{false, true} {
+		proxy, c, pushed := preparePushTest(t)
+		*myFqdn = "127.0.0.1"
+		*scrapeDisableExpectContinue = disable
+		req := httptest.NewRequest("POST", "http://"+l.Addr().String()+"/metrics", strings.NewReader("body"))
+		req.RequestURI = ""
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Second}})
+
+		want := "100-continue"
+		if disable {
+			want = ""
+		}
+		if got := <-expects; got != want {
+			t.Errorf("With --scrape.disable-expect-continue=%t, expected Expect header %q, got %q", disable, want, got)
+		}
+		if resp := <-pushed; resp.StatusCode != http.StatusOK {
+			t.Errorf("With --scrape.disable-expect-continue=%t, expected pushed status 200, got %d", disable, resp.StatusCode)
+		}
+		proxy.Close()
+	}
+}
+
+func TestTooManyPollFailures(t *testing.T) {
+	defer func(v int) { *maxPollFailures = v }(*maxPollFailures)
+	errPoll := errors.New("connection refused")
+	c := &Coordinator{logger: &TestLogger{}}
+
+	*maxPollFailures = 0
+	for i := 0; i < 5; i++ {
+		if c.tooManyPollFailures(errPoll) {
+			t.Fatal("Expected no limit on failed polls by default")
+		}
+	}
+
+	*maxPollFailures = 3
+	c = &Coordinator{logger: &TestLogger{}}
+	for i, want := range []struct {
+		err  error
+		exit bool
+	}{
+		{errPoll, false},
+		{errPoll, false},
+		{nil, false},
+		{errPoll, false},
+		{errPoll, false},
+		{errPoll, true},
+	} {
+		if got := c.tooManyPollFailures(want.err); got != want.exit {
+			t.Errorf("%d: expected %t, got %t", i, want.exit, got)
+		}
+	}
+}
+
+// idleClosingTransport counts the calls to CloseIdleConnections.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestCountPollForReconnect(t *testing.T) {
+	defer func(v int) { *maxPollsPerConnection = v }(*maxPollsPerConnection)
+	transport := &idleClosingTransport{}
+	proxyClient := &http.Client{Transport: transport}
+	c := &Coordinator{logger: &TestLogger{}}
+
+	*maxPollsPerConnection = 0
+	for i := 0; i < 5; i++ {
+		c.countPollForReconnect(proxyClient)
+	}
+	if transport.closed != 0 {
+		t.Errorf("Expected idle connections to be kept by default, closed %d times", transport.closed)
+	}
+
+	*maxPollsPerConnection = 3
+	for i := 1; i <= 7; i++ {
+		c.countPollForReconnect(proxyClient)
+		if want := i / 3; transport.closed != want {
+			t.Errorf("After %d polls, expected idle connections to be closed %d times, got %d", i, want, transport.closed)
+		}
+	}
+}
+
+func TestNotifyPollErrorSampled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer ts.Close()
+	var buf bytes.Buffer
+	c := &Coordinator{logger: log.NewLogfmtLogger(&buf)}
+	c.setProxyURL(ts.URL)
+	*pollPath = "poll"
+	errorLog := &logSampler{n: 1, interval: time.Minute}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := c.doPoll(ts.Client(), ts.Client())
+		if err == nil {
+			t.Fatal("Expected poll to fail")
+		}
+		c.notifyPollError(errorLog, err, time.Second, start.Add(time.Duration(i)*time.Second))
+	}
+	if got := strings.Count(buf.String(), "check the client configuration"); got != 1 {
+		t.Errorf("Expected the rejected poll to be logged once, got %d times:\n%s", got, buf.String())
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("Expected a single log line, got %d:\n%s", got, buf.String())
+	}
+
+	buf.Reset()
+	err := c.doPoll(ts.Client(), ts.Client())
+	c.notifyPollError(errorLog, err, time.Second, start.Add(time.Minute))
+	if !strings.Contains(buf.String(), "suppressed_errors=2") {
+		t.Errorf("Expected the suppressed errors to be reported after a minute, got:\n%s", buf.String())
+	}
+}
+
+func TestPollBackoffGauge(t *testing.T) {
+	defer func(v time.Duration) { *retryInitialWait = v }(*retryInitialWait)
+	*retryInitialWait = 500 * time.Millisecond
+	c := &Coordinator{logger: &TestLogger{}}
+	errorLog := &logSampler{interval: time.Minute}
+	errPoll := errors.New("connection refused")
+
+	for _, next := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		c.notifyPollError(errorLog, errPoll, next, time.Now())
+		if got := testutil.ToFloat64(pollBackoffGauge); got != next.Seconds() {
+			t.Errorf("Expected backoff gauge %v after a failed poll, got %v", next.Seconds(), got)
+		}
+	}
+	c.notifyPollSuccess(errorLog)
+	if got := testutil.ToFloat64(pollBackoffGauge); got != 0.5 {
+		t.Errorf("Expected backoff gauge to be reset to 0.5 after a successful poll, got %v", got)
+	}
+}
+
+func TestValidateWatchdogTimeout(t *testing.T) {
+	defer func(maxWait, protocolWait, minInterval, drainTimeout time.Duration) {
+		*retryMaxWait, *retryProtocolErrorWait, *pollMinInterval, *reloadDrainTimeout = maxWait, protocolWait, minInterval, drainTimeout
+	}(*retryMaxWait, *retryProtocolErrorWait, *pollMinInterval, *reloadDrainTimeout)
+	*retryMaxWait = 5 * time.Second
+	*retryProtocolErrorWait = time.Minute
+	*pollMinInterval = 0
+	*reloadDrainTimeout = 90 * time.Second
+
+	for _, tc := range []struct {
+		timeout time.Duration
+		valid   bool
+	}{
+		{0, true},
+		{2 * time.Minute, true},
+		{90 * time.Second, false},
+		{time.Minute, false},
+		{30 * time.Second, false},
+		{time.Second, false},
+	} {
+		err := validateWatchdogTimeout(tc.timeout, configFromFlags())
+		if tc.valid && err != nil {
+			t.Errorf("Expected watchdog timeout %s to be valid, got %v", tc.timeout, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected watchdog timeout %s to be invalid", tc.timeout)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		*retryInitialWait, *retryMaxWait = initial, max
+	}(*retryInitialWait, *retryMaxWait)
+	defer func(initial, max time.Duration) {
+		*pushRetryInitialWait, *pushRetryMaxWait = initial, max
+	}(*pushRetryInitialWait, *pushRetryMaxWait)
+	*retryInitialWait, *retryMaxWait = time.Second, 5*time.Second
+	*pushRetryInitialWait, *pushRetryMaxWait = time.Second, 5*time.Second
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, configFromFlags()) {
+		t.Errorf("Expected the flags without a file, got %+v", cfg)
+	}
+
+	for _, tc := range []struct {
+		content string
+		valid   bool
+	}{
+		{"labels:\n  env: prod\nproxy_retry:\n  max_wait: 1m\n", true},
+		{"labels:\n  0env: prod\n", false},
+		{"push_retry:\n  initial_wait: 1m\n", false},
+		{"scrape_response_header_timeout: -1s\n", false},
+	} {
+		filename := filepath.Join(dir, "config.yml")
+		if err := ioutil.WriteFile(filename, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(filename)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("Expected %q to be invalid", tc.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to be valid, got %v", tc.content, err)
+			continue
+		}
+		expected := configFromFlags()
+		expected.Labels = map[string]string{"env": "prod"}
+		expected.ProxyRetry.MaxWait = model.Duration(time.Minute)
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Expected %q to only override its settings, got %+v", tc.content, cfg)
+		}
+	}
+}
+
+func TestLoadConfigRestartOnly(t *testing.T) {
+	defer func(initial, max time.Duration) {
+		*retryInitialWait, *retryMaxWait = initial, max
+	}(*retryInitialWait, *retryMaxWait)
+	defer func(initial, max time.Duration) {
+		*pushRetryInitialWait, *pushRetryMaxWait = initial, max
+	}(*pushRetryInitialWait, *pushRetryMaxWait)
+	*retryInitialWait, *retryMaxWait = time.Second, 5*time.Second
+	*pushRetryInitialWait, *pushRetryMaxWait = time.Second, 5*time.Second
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+
+	for content, expected := range map[string]string{
+		"proxy_url: http://proxy:8080\n":  "proxy_url requires a restart to change and can't be reloaded, set --proxy-url instead",
+		"labels:\n  env: prod\nfqdn: a\n": "fqdn requires a restart to change and can't be reloaded, set --fqdn instead",
+		"proxy_urls: http://proxy:8080\n": "field proxy_urls not found",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(filename)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q to fail with %q, got %v", content, expected, err)
+		}
+	}
+}
+
+func TestConfigLabels(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	cfg := configFromFlags()
+	cfg.Labels = map[string]string{"env": "prod", "team": "infra"}
+	c.setConfig(cfg)
+	target := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain; version=0.0.4"}},
+			Body:       ioutil.NopCloser(strings.NewReader("up 1\n")),
+			Request:    r,
+		}, nil
+	})}
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), target)
+	resp := <-pushed
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `up{env="prod",team="infra"} 1`) {
+		t.Errorf("Expected the labels of the configuration to be added, got %q", body)
+	}
+}
+
+func TestSetConfigPushWaits(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}, pushGate: &pushGate{initial: time.Second, max: 5 * time.Second}}
+	cfg := configFromFlags()
+	cfg.PushRetry = retryConfig{InitialWait: model.Duration(2 * time.Second), MaxWait: model.Duration(time.Minute)}
+	c.setConfig(cfg)
+	if c.pushGate.initial != 2*time.Second || c.pushGate.max != time.Minute {
+		t.Errorf("Expected the push gate to wait between 2s and 1m, got %s and %s", c.pushGate.initial, c.pushGate.max)
+	}
+	if c.getConfig() != cfg {
+		t.Error("Expected the configuration to be replaced")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer func(proxyURLV, pollPathV, pushPathV, configFileV string) {
+		*proxyURL, *pollPath, *pushPath, *configFile = proxyURLV, pollPathV, pushPathV, configFileV
+	}(*proxyURL, *pollPath, *pushPath, *configFile)
+	defer func(initial, max, pushInitial, pushMax time.Duration) {
+		*retryInitialWait, *retryMaxWait, *pushRetryInitialWait, *pushRetryMaxWait = initial, max, pushInitial, pushMax
+	}(*retryInitialWait, *retryMaxWait, *pushRetryInitialWait, *pushRetryMaxWait)
+	defer func(v []string) { *localScrapeAllowedPorts = v }(*localScrapeAllowedPorts)
+	*proxyURL = "http://proxy:8080/"
+	*pollPath, *pushPath = "poll", "push"
+	*configFile = ""
+	*retryInitialWait, *retryMaxWait = time.Second, 5*time.Second
+	*pushRetryInitialWait, *pushRetryMaxWait = time.Second, 5*time.Second
+
+	if code := runCheckConfig(&TestLogger{}); code != 0 {
+		t.Errorf("Expected exit code 0 for a valid configuration, got %d", code)
+	}
+
+	*proxyURL = "proxy:8080"
+	*localScrapeAllowedPorts = []string{"http"}
+	*configFile = "/nonexistent/config.yml"
+	if errs := checkConfig(&TestLogger{}); len(errs) != 3 {
+		t.Errorf("Expected all 3 problems to be reported, got %v", errs)
+	}
+	if code := runCheckConfig(&TestLogger{}); code != exitConfig {
+		t.Errorf("Expected exit code %d for an invalid configuration, got %d", exitConfig, code)
+	}
+}
+
+func TestTargetLabelIsOriginalHost(t *testing.T) {
+	proxy, c, pushed := preparePushTest(t)
+	defer proxy.Close()
+	target := &recordingTransport{urls: make(chan string, 1)}
+	*myFqdn = "127.0.0.1"
+	defer func(v string) { *localScrape = v }(*localScrape)
+	*localScrape = "true"
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:9177/metrics", nil)
+	req.RequestURI = ""
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client(), &http.Client{Transport: target})
+	if got := <-target.urls; got != "http://localhost:9177/metrics" {
+		t.Fatalf("Expected the scrape to be rewritten to localhost, got %s", got)
+	}
+	<-pushed
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() != "target" {
+					continue
+				}
+				if l.GetValue() == "localhost:9177" {
+					t.Errorf("Expected %s to be labelled with the original host, got target=%q", mf.GetName(), l.GetValue())
+				}
+				if l.GetValue() == "127.0.0.1:9177" {
+					found[mf.GetName()] = true
+				}
+			}
+		}
+	}
+	for _, name := range []string{"pushprox_client_last_successful_push_timestamp_seconds", "pushprox_client_scrape_consecutive_failures"} {
+		if !found[name] {
+			t.Errorf("Expected %s{target=\"127.0.0.1:9177\"}", name)
+		}
+	}
+}
+
+func TestProxyCapabilities(t *testing.T) {
+	defer func(v string) { *pushCompression = v }(*pushCompression)
+	*pushCompression = "auto"
+
+	for _, advertised := range []bool{false, true} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if advertised {
+				w.Header().Set(util.CapabilitiesHeader, util.PushGzipCapability)
+			}
+			fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
+		}))
+		c := &Coordinator{logger: &TestLogger{}}
+		c.setProxyURL(ts.URL)
+		*pollPath = "poll"
+		*pushPath = "push"
+
+		if c.compressPushes() {
+			t.Error("Expected no compression before the proxy advertised anything")
+		}
+		if err := c.doPoll(ts.Client(), ts.Client()); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.proxySupports(util.PushGzipCapability); got != advertised {
+			t.Errorf("Expected support for %s to be %t, got %t", util.PushGzipCapability, advertised, got)
+		}
+		if got := c.compressPushes(); got != advertised {
+			t.Errorf("Expected --push.compression=auto to compress pushes: %t, got %t", advertised, got)
+		}
+		ts.Close()
+	}
+}
+
+func TestPushCompressionAuto(t *testing.T) {
+	defer func(v string) { *pushCompression = v }(*pushCompression)
+	*pushCompression = "auto"
+	*myFqdn = "127.0.0.1"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	for _, advertised := range []bool{false, true} {
+		proxy, c, pushed := preparePushTest(t)
+		if advertised {
+			c.setCapabilities(util.Capabilities{util.PushGzipCapability: true})
+		} else {
+			c.setCapabilities(util.Capabilities{})
+		}
+		req := httptest.NewRequest("GET", target.URL+"/metrics", nil)
+		req.RequestURI = ""
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client(), target.Client())
+
+		want := ""
+		if advertised {
+			want = "gzip"
+		}
+		if got := (<-pushed).Header.Get("Content-Encoding"); got != want {
+			t.Errorf("Expected pushed Content-Encoding %q when the proxy advertises %s: %t, got %q", want, util.PushGzipCapability, advertised, got)
+		}
+		proxy.Close()
+	}
+}
+
+func TestLifecycleHandlers(t *testing.T) {
+	c := &Coordinator{logger: &TestLogger{}}
+	reloads := 0
+	reload := func() error {
+		reloads++
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/-/reload", nil))
+	if w.Code != http.StatusNotFound || reloads != 0 {
+		t.Errorf("Expected /-/reload not to be served without --web.enable-lifecycle, got %d", w.Code)
+	}
+
+	registerLifecycleHandlers(mux, c, reload, make(chan struct{}))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/-/reload", nil))
+	if w.Code != http.StatusOK || reloads != 1 {
+		t.Errorf("Expected /-/reload to reload with --web.enable-lifecycle, got %d and %d reloads", w.Code, reloads)
+	}
 }
@@ -0,0 +1,61 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pollFloorGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "pushprox_client_poll_adaptive_floor_seconds",
+		Help: "Current minimum time between the start of two polls set by --poll.adaptive-floor",
+	},
+)
+
+func init() {
+	registry.MustRegister(pollFloorGauge)
+}
+
+// pollFloor is a minimum time between polls that adapts to the poll error
+// rate, independently of the retry backoff: it doubles from step with every
+// failed poll, up to max, and halves with every successful one, dropping to
+// 0 below step. Polls that mostly fail are spread out even if the backoff
+// keeps being reset by the odd success. It's only used by the poll loop.
+type pollFloor struct {
+	step, max time.Duration
+	current   time.Duration
+}
+
+// observe updates the floor with the result of a poll and returns it.
+func (f *pollFloor) observe(err error) time.Duration {
+	if err != nil {
+		f.current *= 2
+		if f.current < f.step {
+			f.current = f.step
+		}
+		if f.current > f.max {
+			f.current = f.max
+		}
+	} else {
+		f.current /= 2
+		if f.current < f.step {
+			f.current = 0
+		}
+	}
+	pollFloorGauge.Set(f.current.Seconds())
+	return f.current
+}
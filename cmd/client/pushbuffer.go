@@ -0,0 +1,127 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Push buffer metrics.
+var (
+	pushBufferGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_push_buffer_entries",
+			Help: "Number of failed pushes waiting to be retried",
+		},
+	)
+	pushBufferDroppedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_push_buffer_dropped_total",
+			Help: "Number of buffered pushes dropped without being sent",
+		}, []string{"reason"},
+	)
+)
+
+func init() {
+	registry.MustRegister(pushBufferGauge, pushBufferDroppedCounter)
+}
+
+// bufferedPush is a serialized scrape response that failed to be pushed.
+type bufferedPush struct {
+	id      string
+	body    []byte
+	expires time.Time
+}
+
+// pushBuffer is a bounded in-memory queue of failed pushes. Pushes expire
+// after the TTL, so that stale metrics don't reach Prometheus, or earlier at
+// the deadline of their scrape, after which Prometheus has given up on them.
+type pushBuffer struct {
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	pushes   []bufferedPush
+	flushing bool
+}
+
+func newPushBuffer(size int, ttl time.Duration) *pushBuffer {
+	return &pushBuffer{size: size, ttl: ttl}
+}
+
+// add buffers a push of a scrape with the given deadline, none if zero,
+// dropping the oldest one if the buffer is full.
+func (b *pushBuffer) add(id string, body []byte, deadline time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	if len(b.pushes) >= b.size {
+		b.pushes = b.pushes[1:]
+		pushBufferDroppedCounter.WithLabelValues("full").Inc()
+	}
+	expires := time.Now().Add(b.ttl)
+	if !deadline.IsZero() && deadline.Before(expires) {
+		expires = deadline
+	}
+	b.pushes = append(b.pushes, bufferedPush{id: id, body: body, expires: expires})
+	pushBufferGauge.Set(float64(len(b.pushes)))
+}
+
+// expire drops the expired pushes, b.mu must be held.
+func (b *pushBuffer) expire() {
+	now := time.Now()
+	pushes := b.pushes[:0]
+	for _, p := range b.pushes {
+		if now.Before(p.expires) {
+			pushes = append(pushes, p)
+		} else {
+			pushBufferDroppedCounter.WithLabelValues("expired").Inc()
+		}
+	}
+	b.pushes = pushes
+	pushBufferGauge.Set(float64(len(b.pushes)))
+}
+
+// startFlush takes the unexpired pushes out of the buffer. It returns
+// nothing if another flush is in progress.
+func (b *pushBuffer) startFlush() []bufferedPush {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flushing {
+		return nil
+	}
+	b.expire()
+	pushes := b.pushes
+	b.pushes = nil
+	b.flushing = len(pushes) > 0
+	pushBufferGauge.Set(0)
+	return pushes
+}
+
+// endFlush completes a flush, putting the unsent pushes back in front of
+// the ones buffered in the meantime.
+func (b *pushBuffer) endFlush(unsent []bufferedPush) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushing = false
+	b.pushes = append(append([]bufferedPush{}, unsent...), b.pushes...)
+	if len(b.pushes) > b.size {
+		pushBufferDroppedCounter.WithLabelValues("full").Add(float64(len(b.pushes) - b.size))
+		b.pushes = b.pushes[len(b.pushes)-b.size:]
+	}
+	b.expire()
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pushGateOpenGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "pushprox_client_push_gate_open",
+		Help: "Whether pushes are sent without delay (1) or delayed because recent pushes failed (0)",
+	},
+)
+
+func init() {
+	registry.MustRegister(pushGateOpenGauge)
+	pushGateOpenGauge.Set(1)
+}
+
+// pushGate delays all pushes after pushes failed, backing off exponentially
+// from initial to max with every further failure, so that concurrent scrapes
+// don't each keep hitting a struggling proxy. A successful push opens the
+// gate again. A nil *pushGate never delays.
+type pushGate struct {
+	mu          sync.Mutex
+	initial     time.Duration
+	max         time.Duration
+	failures    int
+	closedUntil time.Time
+}
+
+// setWaits changes the backoff, e.g. on reload. It applies from the next
+// failed push.
+func (g *pushGate) setWaits(initial, max time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.initial, g.max = initial, max
+}
+
+// wait blocks until the gate is open or ctx is done.
+func (g *pushGate) wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	delay := time.Until(g.closedUntil)
+	g.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// record updates the gate with the result of a push.
+func (g *pushGate) record(err error, now time.Time) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		g.failures = 0
+		g.closedUntil = time.Time{}
+		pushGateOpenGauge.Set(1)
+		return
+	}
+	g.failures++
+	delay := g.initial
+	for i := 1; i < g.failures && delay < g.max; i++ {
+		delay *= 2
+	}
+	if delay > g.max {
+		delay = g.max
+	}
+	g.closedUntil = now.Add(delay)
+	pushGateOpenGauge.Set(0)
+}
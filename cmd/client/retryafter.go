@@ -0,0 +1,168 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// overloadError is returned when the proxy sheds load, wait is how long it
+// asked us to back off for, 0 if it didn't say.
+type overloadError struct {
+	status string
+	wait   time.Duration
+}
+
+func (e *overloadError) Error() string {
+	if e.wait > 0 {
+		return fmt.Sprintf("proxy is overloaded: %s, retry after %s", e.status, e.wait)
+	}
+	return fmt.Sprintf("proxy is overloaded: %s", e.status)
+}
+
+// protocolError is returned when the proxy rejects a request in a way that
+// retrying soon won't fix, e.g. because of bad credentials.
+type protocolError struct {
+	status string
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("proxy rejected request: %s", e.status)
+}
+
+// checkRejected returns a *protocolError if resp is a 400, 401 or 403.
+func checkRejected(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return &protocolError{status: resp.Status}
+	}
+	return nil
+}
+
+// errUnknownScrape is returned when the proxy doesn't know the scrape a push
+// is for, e.g. because it restarted.
+var errUnknownScrape = errors.New("proxy doesn't know the pushed scrape")
+
+// errExpiredScrape is returned when the proxy is no longer waiting for the
+// scrape a push is for, e.g. because it timed out.
+var errExpiredScrape = errors.New("proxy is no longer waiting for the pushed scrape")
+
+// checkUnknownScrape returns errUnknownScrape or errExpiredScrape if resp
+// says that the proxy doesn't know the pushed scrape or is no longer
+// waiting for it.
+func checkUnknownScrape(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound && resp.Header.Get(util.ErrorHeader) == util.UnknownScrapeError:
+		return errUnknownScrape
+	case resp.StatusCode == http.StatusGone && resp.Header.Get(util.ErrorHeader) == util.ExpiredScrapeError:
+		return errExpiredScrape
+	}
+	return nil
+}
+
+// errorClass returns a coarse category of an error talking to the proxy.
+func errorClass(err error) string {
+	var (
+		overloadErr *overloadError
+		protocolErr *protocolError
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &overloadErr):
+		return "overload"
+	case errors.As(err, &protocolErr):
+		return "protocol"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// checkOverload returns an *overloadError if resp is a 429 or 503.
+func checkOverload(resp *http.Response, now time.Time) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	wait, _ := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	return &overloadError{status: resp.Status, wait: wait}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(h, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	if wait := t.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// retryAfterBackOff waits as long as the proxy asked for after an
+// *overloadError, capped at max, protocolWait after a *protocolError if set,
+// and as long as the wrapped backoff says otherwise. Errors have to be
+// passed to observe.
+type retryAfterBackOff struct {
+	backoff.BackOff
+	max          time.Duration
+	protocolWait time.Duration
+	wait         time.Duration
+}
+
+// observe records the result of an attempt.
+func (b *retryAfterBackOff) observe(err error) {
+	b.wait = 0
+	var (
+		overloadErr *overloadError
+		protocolErr *protocolError
+	)
+	switch {
+	case errors.As(err, &overloadErr):
+		b.wait = overloadErr.wait
+		if b.max > 0 && b.wait > b.max {
+			b.wait = b.max
+		}
+	case errors.As(err, &protocolErr):
+		b.wait = b.protocolWait
+	}
+}
+
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop || b.wait == 0 {
+		return next
+	}
+	return b.wait
+}
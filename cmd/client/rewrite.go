@@ -0,0 +1,52 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// urlRewrite rewrites scrape target URLs matching a regular expression.
+type urlRewrite struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// parseURLRewrite parses a rewrite given as <regex>=<replacement>. The
+// replacement may refer to capture groups as in regexp.Expand.
+func parseURLRewrite(s string) (*urlRewrite, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("url rewrite %q must be of the form <regex>=<replacement>", s)
+	}
+	regex, err := regexp.Compile(s[:i])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid url rewrite regex %q", s[:i])
+	}
+	return &urlRewrite{regex: regex, replacement: s[i+1:]}, nil
+}
+
+// apply returns the rewritten URL, u itself is left untouched.
+func (r *urlRewrite) apply(u *url.URL) (*url.URL, error) {
+	rewritten, err := url.Parse(r.regex.ReplaceAllString(u.String(), r.replacement))
+	if err != nil {
+		return nil, errors.Wrapf(err, "rewriting %s", u)
+	}
+	return rewritten, nil
+}
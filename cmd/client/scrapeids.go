@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Number of recent scrape ids remembered to detect duplicates.
+const recentScrapeIDsSize = 1024
+
+// Scrape request metrics. A growing difference between the two counters
+// means that the proxy dispatches scrapes more than once.
+var (
+	scrapeRequestsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrape_requests_total",
+			Help: "Number of scrape requests received from the proxy",
+		},
+	)
+	uniqueScrapeIDsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_unique_scrape_ids_total",
+			Help: "Number of scrape requests received whose id wasn't among the recently seen ones",
+		},
+	)
+)
+
+func init() {
+	registry.MustRegister(scrapeRequestsCounter, uniqueScrapeIDsCounter)
+}
+
+// recentIDs remembers the last recentScrapeIDsSize ids in a ring buffer.
+// The zero value is ready to use.
+type recentIDs struct {
+	mu   sync.Mutex
+	ring []string
+	next int
+	ids  map[string]struct{}
+}
+
+// add records id and reports whether it was already among the recent ids.
+func (r *recentIDs) add(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ids == nil {
+		r.ring = make([]string, recentScrapeIDsSize)
+		r.ids = map[string]struct{}{}
+	}
+	if _, ok := r.ids[id]; ok {
+		return true
+	}
+	if len(r.ids) == len(r.ring) {
+		delete(r.ids, r.ring[r.next])
+	}
+	r.ring[r.next] = id
+	r.ids[id] = struct{}{}
+	r.next = (r.next + 1) % len(r.ring)
+	return false
+}
+
+// observeScrapeRequest updates the scrape request metrics for id.
+func (r *recentIDs) observeScrapeRequest(id string) {
+	scrapeRequestsCounter.Inc()
+	if !r.add(id) {
+		uniqueScrapeIDsCounter.Inc()
+	}
+}
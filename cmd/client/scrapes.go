@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// inFlightScrape is a scrape being handled.
+type inFlightScrape struct {
+	id, target string
+	start      time.Time
+}
+
+// scrapeStatus is an in-flight scrape as listed by /-/scrapes.
+type scrapeStatus struct {
+	ScrapeID       string  `json:"scrape_id"`
+	Target         string  `json:"target"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// inFlightScrapes tracks the scrapes being handled, from receiving the
+// scrape request until the push is done. The zero value is ready to use.
+type inFlightScrapes struct {
+	mu      sync.Mutex
+	next    uint64
+	scrapes map[uint64]inFlightScrape
+}
+
+// start records a scrape started at now and returns the function to call
+// once it's done.
+func (s *inFlightScrapes) start(id, target string, now time.Time) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scrapes == nil {
+		s.scrapes = map[uint64]inFlightScrape{}
+	}
+	// Scrape ids come from the proxy and aren't necessarily unique.
+	key := s.next
+	s.next++
+	s.scrapes[key] = inFlightScrape{id: id, target: target, start: now}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.scrapes, key)
+	}
+}
+
+// list returns the max oldest scrapes in flight at now, oldest first, and
+// the total number of scrapes in flight.
+func (s *inFlightScrapes) list(now time.Time, max int) ([]scrapeStatus, int) {
+	s.mu.Lock()
+	scrapes := make([]inFlightScrape, 0, len(s.scrapes))
+	for _, scrape := range s.scrapes {
+		scrapes = append(scrapes, scrape)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(scrapes, func(i, j int) bool { return scrapes[i].start.Before(scrapes[j].start) })
+	total := len(scrapes)
+	if total > max {
+		scrapes = scrapes[:max]
+	}
+	statuses := make([]scrapeStatus, 0, len(scrapes))
+	for _, scrape := range scrapes {
+		statuses = append(statuses, scrapeStatus{
+			ScrapeID:       scrape.id,
+			Target:         scrape.target,
+			ElapsedSeconds: now.Sub(scrape.start).Seconds(),
+		})
+	}
+	return statuses, total
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// isSelfScrape reports whether u points at the client's own metrics
+// listener on listenAddr. Only addresses that are certainly local are
+// considered, so no name resolution is done.
+func isSelfScrape(u *url.URL, listenAddr string) bool {
+	if listenAddr == "" {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	if port != listenPort {
+		return false
+	}
+
+	host := u.Hostname()
+	if listenIP := net.ParseIP(listenHost); listenHost != "" && (listenIP == nil || !listenIP.IsUnspecified()) {
+		// Listening on a specific address.
+		if strings.EqualFold(host, listenHost) {
+			return true
+		}
+		return isLoopback(listenHost) && isLoopback(host)
+	}
+	// Listening on all addresses.
+	return isLoopback(host) || net.ParseIP(host).IsUnspecified() || strings.EqualFold(host, *myFqdn)
+}
+
+// isSelfScrapeAny reports whether u points at any of the client's metrics
+// listeners on listenAddrs.
+func isSelfScrapeAny(u *url.URL, listenAddrs []string) bool {
+	for _, listenAddr := range listenAddrs {
+		if isSelfScrape(u, listenAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMappedSelfScrape reports whether --local-scrape or --scrape.url-rewrite
+// turned the scrape of target into one of mapped, a metrics listener on
+// listenAddrs. Scrapes addressed to a listener in the first place, e.g. to
+// monitor a client behind NAT through the proxy, aren't mapped, and neither
+// are those of --self-metrics-path.
+func isMappedSelfScrape(target, mapped *url.URL, listenAddrs []string) bool {
+	if strings.EqualFold(target.Host, mapped.Host) && target.Scheme == mapped.Scheme {
+		return false
+	}
+	if *selfMetricsPath != "" && mapped.Path == *selfMetricsPath {
+		return false
+	}
+	return isSelfScrapeAny(mapped, listenAddrs)
+}
+
+// mappedScrapeTargets returns the URLs that targets are mapped onto, as far
+// as known from the configuration: the allowed ports of --local-scrape and
+// the replacement of --scrape.url-rewrite if it's a fixed URL.
+func mappedScrapeTargets() []string {
+	var targets []string
+	if *localScrape != "" {
+		for _, port := range *localScrapeAllowedPorts {
+			targets = append(targets, "http://localhost:"+port+"/")
+		}
+	}
+	if *scrapeURLRewrite != "" {
+		replacement := (*scrapeURLRewrite)[strings.Index(*scrapeURLRewrite, "=")+1:]
+		if u, err := url.Parse(replacement); err == nil && u.Host != "" && !strings.Contains(replacement, "$") {
+			targets = append(targets, replacement)
+		}
+	}
+	return targets
+}
+
+// selfScrapeTargets returns the targets that are served by one of the
+// client's metrics listeners on listenAddrs, and so can't be scraped.
+func selfScrapeTargets(listenAddrs, targets []string) []string {
+	var conflicts []string
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		if isSelfScrapeAny(u, listenAddrs) {
+			conflicts = append(conflicts, target)
+		}
+	}
+	return conflicts
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// otherTarget is the target label of the targets beyond the limit.
+const otherTarget = "other"
+
+// targetLabeler bounds the number of distinct values of target labels. The
+// first max targets are used as is, later ones are all labeled "other".
+type targetLabeler struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// label returns the label value to use for target. A nil targetLabeler or
+// a max of 0 doesn't limit the targets.
+func (l *targetLabeler) label(target string) string {
+	if l == nil || l.max <= 0 {
+		return target
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[target]; ok {
+		return target
+	}
+	if len(l.seen) >= l.max {
+		return otherTarget
+	}
+	if l.seen == nil {
+		l.seen = map[string]struct{}{}
+	}
+	l.seen[target] = struct{}{}
+	return target
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Client certificate metrics, only registered if a certificate is configured.
+var (
+	tlsCertNotAfterGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_tls_cert_not_after_timestamp_seconds",
+			Help: "Time after which the client certificate is no longer valid",
+		},
+	)
+	tlsCertNotBeforeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_tls_cert_not_before_timestamp_seconds",
+			Help: "Time before which the client certificate is not valid yet",
+		},
+	)
+)
+
+// loadTLSConfig builds the TLS configuration used to talk to the proxy and
+// the scrape targets from the certificate files given on the command line.
+func loadTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "certificate or key is invalid")
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate")
+		}
+
+		// Setup HTTPS client
+		tlsConfig.Certificates = []tls.Certificate{cert}
+
+		tlsConfig.BuildNameToCertificate()
+	}
+
+	if *caCertFile != "" {
+		caCertPool, err := loadCAPool(*caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	return tlsConfig, nil
+}
+
+// newTLSConfig returns a TLS configuration with the version and cipher
+// suites given on the command line. Unlike loadTLSConfig, it reads no
+// files, so its errors are flag errors.
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if *tlsMinVersion != "" {
+		version, err := parseTLSVersion(*tlsMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(*tlsCipherSuites) > 0 {
+		suites, err := parseCipherSuites(*tlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+	return tlsConfig, nil
+}
+
+// tlsVersions are the TLS versions --tls.min-version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version like "1.3".
+func parseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return version, nil
+}
+
+// parseCipherSuites looks up the ids of the cipher suites with the given
+// names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure cipher suites
+// are refused, and so are TLS 1.3 ones, which Go doesn't let configure.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suitesByName := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suitesByName[suite.Name] = suite
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := suitesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		if !supportsPreTLS13(suite) {
+			return nil, fmt.Errorf("TLS cipher suite %q is a TLS 1.3 one, which aren't configurable", name)
+		}
+		suites = append(suites, suite.ID)
+	}
+	return suites, nil
+}
+
+// supportsPreTLS13 returns whether suite can be used with TLS 1.2 or
+// earlier.
+func supportsPreTLS13(suite *tls.CipherSuite) bool {
+	for _, v := range suite.SupportedVersions {
+		if v < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCAPool builds a certificate pool from the PEM encoded CA certificates
+// in file.
+func loadCAPool(file string) (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "not able to read cacert file")
+	}
+	caCertPool := x509.NewCertPool()
+	if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
+		return nil, errors.New("failed to use cacert file as ca certificate")
+	}
+	return caCertPool, nil
+}
+
+// caReloader watches a CA certificate file and passes a pool built from it
+// to apply whenever its modification time or size changes. If the new file
+// can't be loaded, apply isn't called and the previous pool stays in use
+// until the file changes again.
+type caReloader struct {
+	logger log.Logger
+	file   string
+	apply  func(*x509.CertPool)
+
+	modTime time.Time
+	size    int64
+}
+
+// newCAReloader returns a caReloader for file, treating its current contents
+// as already applied.
+func newCAReloader(logger log.Logger, file string, apply func(*x509.CertPool)) *caReloader {
+	r := &caReloader{logger: logger, file: file, apply: apply}
+	if fi, err := os.Stat(file); err == nil {
+		r.modTime, r.size = fi.ModTime(), fi.Size()
+	}
+	return r
+}
+
+// check reloads the file if it changed since the last check.
+func (r *caReloader) check() {
+	fi, err := os.Stat(r.file)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Failed to check CA certificate file, keeping the previous CA certificates", "file", r.file, "err", err)
+		return
+	}
+	if fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return
+	}
+	r.modTime, r.size = fi.ModTime(), fi.Size()
+	pool, err := loadCAPool(r.file)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Failed to reload CA certificates, keeping the previous ones", "file", r.file, "err", err)
+		return
+	}
+	r.apply(pool)
+	level.Info(r.logger).Log("msg", "Reloaded CA certificates", "file", r.file)
+}
+
+// run checks the file every interval, forever.
+func (r *caReloader) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.check()
+	}
+}
+
+// scrapeTLSConfig returns the TLS config to use for scrape targets, which
+// differs from the one for the proxy if --scrape.tls.server-name is set.
+func scrapeTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	if *scrapeServerName == "" {
+		return tlsConfig
+	}
+	scrapeConfig := tlsConfig.Clone()
+	scrapeConfig.ServerName = *scrapeServerName
+	return scrapeConfig
+}
+
+// parseCertPins parses SHA-256 certificate fingerprints given in hex,
+// optionally with colons between the bytes as printed by openssl.
+func parseCertPins(pins []string) ([][]byte, error) {
+	var parsed [][]byte
+	for _, pin := range pins {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", pin)
+		}
+		parsed = append(parsed, fingerprint)
+	}
+	return parsed, nil
+}
+
+// proxyTLSConfig returns the TLS config to use for the proxy. With pins, the
+// certificate of the proxy must also have one of the pinned fingerprints,
+// on top of the usual verification against the CA certificates.
+func proxyTLSConfig(tlsConfig *tls.Config, pins [][]byte) *tls.Config {
+	if len(pins) == 0 {
+		return tlsConfig
+	}
+	proxyConfig := tlsConfig.Clone()
+	// Unlike VerifyPeerCertificate, this is also called for resumed sessions.
+	proxyConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("proxy sent no certificate")
+		}
+		fingerprint := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		for _, pin := range pins {
+			if bytes.Equal(fingerprint[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("proxy certificate with fingerprint %x is not pinned with --proxy.tls.pin", fingerprint)
+	}
+	return proxyConfig
+}
+
+// observeCertificate exposes the validity period of the client certificate
+// in tlsConfig, if any.
+func observeCertificate(tlsConfig *tls.Config) {
+	if len(tlsConfig.Certificates) == 0 || tlsConfig.Certificates[0].Leaf == nil {
+		return
+	}
+	leaf := tlsConfig.Certificates[0].Leaf
+	tlsCertNotAfterGauge.Set(float64(leaf.NotAfter.Unix()))
+	tlsCertNotBeforeGauge.Set(float64(leaf.NotBefore.Unix()))
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Poll timing metrics.
+var (
+	pollDNSHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pushprox_client_poll_dns_seconds",
+			Help: "Time taken resolving the proxy address when polling",
+		},
+	)
+	pollConnectHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pushprox_client_poll_connect_seconds",
+			Help: "Time taken connecting to the proxy when polling",
+		},
+	)
+	pollTLSHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pushprox_client_poll_tls_seconds",
+			Help: "Time taken by the TLS handshake with the proxy when polling",
+		},
+	)
+	pollTTFBHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_poll_time_to_first_byte_seconds",
+			Help:    "Time from sending a poll until the first byte of the response, i.e. until a scrape was handed out",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		},
+	)
+)
+
+func init() {
+	registry.MustRegister(pollDNSHistogram, pollConnectHistogram, pollTLSHistogram, pollTTFBHistogram)
+}
+
+// newPollTrace returns a trace observing the timings of a single poll.
+func newPollTrace() *httptrace.ClientTrace {
+	var (
+		mu                               sync.Mutex
+		dnsStart, connectStart, tlsStart time.Time
+	)
+	start := time.Now()
+	since := func(t *time.Time) float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*t).Seconds()
+	}
+	mark := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			pollDNSHistogram.Observe(since(&dnsStart))
+		},
+		ConnectStart: func(_, _ string) { mark(&connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				pollConnectHistogram.Observe(since(&connectStart))
+			}
+		},
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				pollTLSHistogram.Observe(since(&tlsStart))
+			}
+		},
+		GotFirstResponseByte: func() {
+			pollTTFBHistogram.Observe(time.Since(start).Seconds())
+		},
+	}
+}
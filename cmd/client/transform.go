@@ -0,0 +1,131 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/expfmt"
+)
+
+// BodyTransformer transforms the bodies of scrape responses before they are
+// pushed.
+type BodyTransformer interface {
+	// Transform returns the transformed body, updating the response headers
+	// in header to match, e.g. its Content-Encoding. Errors fail the scrape.
+	Transform(header http.Header, body io.Reader) (io.Reader, error)
+}
+
+// transformBody runs body through transformers in order.
+func transformBody(transformers []BodyTransformer, header http.Header, body []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(body)
+	for _, t := range transformers {
+		var err error
+		if r, err = t.Transform(header, r); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(r)
+}
+
+// newBodyTransformers returns the built-in transformers named in names, in
+// the same order.
+func newBodyTransformers(logger log.Logger, names []string) ([]BodyTransformer, error) {
+	var transformers []BodyTransformer
+	for _, name := range names {
+		switch name {
+		case "add-fqdn-label":
+			if *scrapeAddFQDNLabel == "" {
+				return nil, errors.New("the add-fqdn-label transformer requires --scrape.add-fqdn-label")
+			}
+			transformers = append(transformers, labelTransformer{logger: logger, labels: map[string]string{*scrapeAddFQDNLabel: *myFqdn}})
+		case "validate":
+			transformers = append(transformers, validateTransformer{})
+		default:
+			return nil, fmt.Errorf("unknown scrape transformer %q", name)
+		}
+	}
+	return transformers, nil
+}
+
+// decompressTransformer decompresses gzip encoded bodies, which targets may
+// send even if not asked to. It runs before the transformers of
+// --scrape.transform, so that they see the plain body.
+type decompressTransformer struct{}
+
+func (decompressTransformer) Transform(header http.Header, body io.Reader) (io.Reader, error) {
+	if !strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := gunzip(b)
+	if err != nil {
+		return nil, err
+	}
+	header.Del("Content-Encoding")
+	return bytes.NewReader(decompressed), nil
+}
+
+// labelTransformer adds the labels to every series of text format bodies.
+// Bodies that can't be parsed are passed on unchanged.
+type labelTransformer struct {
+	logger log.Logger
+	labels map[string]string
+}
+
+func (t labelTransformer) Transform(header http.Header, body io.Reader) (io.Reader, error) {
+	if !isTextFormat(header) {
+		return body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	labeled, err := addLabels(b, t.labels)
+	if err != nil {
+		level.Warn(t.logger).Log("msg", "Failed to add labels, pushing the response unchanged", "err", err)
+		return bytes.NewReader(b), nil
+	}
+	return bytes.NewReader(labeled), nil
+}
+
+// validateTransformer fails scrapes whose text format bodies can't be
+// parsed, rather than letting Prometheus fail to ingest them.
+type validateTransformer struct{}
+
+func (validateTransformer) Transform(header http.Header, body io.Reader) (io.Reader, error) {
+	if !isTextFormat(header) {
+		return body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var parser expfmt.TextParser
+	if _, err := parser.TextToMetricFamilies(bytes.NewReader(b)); err != nil {
+		return nil, errors.Wrap(err, "invalid scrape response")
+	}
+	return bytes.NewReader(b), nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// serve serves handler on addr in the background until the listener fails
+// or the returned server is closed. Without keepAlives, connections are
+// closed after every request.
+func serve(logger log.Logger, addr string, handler http.Handler, keepAlives bool) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	srv.SetKeepAlivesEnabled(keepAlives)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			level.Warn(logger).Log("msg", "ListenAndServe", "addr", addr, "err", err)
+		}
+	}()
+	return srv
+}
+
+// registry holds the client's own metrics. The Go runtime and process
+// metrics are added to it in main, unless disabled.
+var registry = prometheus.NewRegistry()
+
+// registerRuntimeCollectors adds the Go runtime and process metrics to r.
+func registerRuntimeCollectors(r *prometheus.Registry) {
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the client's own metrics. The format is negotiated
+// from the Accept header, with preferProtobuf the delimited protobuf format
+// is served whenever the scraper accepts it, regardless of its preference.
+func metricsHandler(enableOpenMetrics, preferProtobuf bool) http.Handler {
+	handler := promhttp.InstrumentMetricHandler(
+		registry,
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			EnableOpenMetrics: enableOpenMetrics,
+		}),
+	)
+	if !preferProtobuf {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsProtobuf(r.Header) {
+			r = r.Clone(r.Context())
+			r.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// acceptsProtobuf reports whether the Accept header in h allows the
+// delimited protobuf format.
+func acceptsProtobuf(h http.Header) bool {
+	for _, accept := range h.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || mediaType != expfmt.ProtoType || params["proto"] != expfmt.ProtoProtocol {
+				continue
+			}
+			if enc, ok := params["encoding"]; ok && enc != "delimited" {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// healthyHandler reports that the client is up.
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "PushProx client is Healthy.\n")
+	})
+}
+
+// readyHandler reports whether the client is able to poll the proxy, i.e.
+// whether a poll succeeded and the last one didn't fail. Deep checks with ?deep=true also
+// require target to be scrapeable.
+func readyHandler(c *Coordinator, target *targetCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("deep") == "true" {
+			deepReady(w, c, target)
+			return
+		}
+		if err := c.pollError(); err != nil {
+			http.Error(w, fmt.Sprintf("PushProx client is not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "PushProx client is Ready.\n")
+	})
+}
+
+// checkStatus is the state of one subsystem in deep readiness checks.
+type checkStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newCheckStatus(err error) checkStatus {
+	if err != nil {
+		return checkStatus{Error: err.Error()}
+	}
+	return checkStatus{OK: true}
+}
+
+// deepReady reports the state of the proxy connectivity and the target as
+// JSON, failing unless both are fine.
+func deepReady(w http.ResponseWriter, c *Coordinator, target *targetCheck) {
+	targetErr := errors.New("no ready target configured")
+	if target != nil {
+		targetErr = target.check()
+	}
+	status := struct {
+		Proxy  checkStatus `json:"proxy"`
+		Target checkStatus `json:"target"`
+	}{newCheckStatus(c.pollError()), newCheckStatus(targetErr)}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Proxy.OK || !status.Target.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// readyTargetDefault returns the URL of the target of deep readiness checks:
+// --web.ready-target-url or, with --local-scrape, the first port of
+// --local-scrape.allowed-ports on localhost.
+func readyTargetDefault() string {
+	if *readyTargetURL != "" || *localScrape == "" || len(*localScrapeAllowedPorts) == 0 {
+		return *readyTargetURL
+	}
+	return (&url.URL{Scheme: "http", Host: net.JoinHostPort("localhost", (*localScrapeAllowedPorts)[0]), Path: "/metrics"}).String()
+}
+
+// targetCheck scrapes a target to check that it's up, caching the result
+// for ttl so that frequent probes don't hammer the target.
+type targetCheck struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (t *targetCheck) check() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.checked.IsZero() && time.Since(t.checked) < t.ttl {
+		return t.err
+	}
+	t.err = t.scrape()
+	t.checked = time.Now()
+	return t.err
+}
+
+func (t *targetCheck) scrape() error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status scraping %s: %s", t.url, resp.Status)
+	}
+	return nil
+}
+
+// reloadHandler applies the reloadable part of the configuration on POST
+// requests, reporting validation errors back to the caller.
+func reloadHandler(logger log.Logger, reload func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := reload()
+		if errors.Is(err, errDrainInProgress) {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error reloading configuration", "err", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusBadRequest)
+			return
+		}
+		level.Info(logger).Log("msg", "Completed loading of configuration")
+	})
+}
+
+// fqdnHandler returns the FQDNs the client registers with the proxy as
+// JSON, e.g. {"fqdns":["client.example.com"]}.
+func fqdnHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			FQDNs []string `json:"fqdns"`
+		}{[]string{*myFqdn}})
+	})
+}
+
+// maxListedScrapes bounds the number of scrapes listed by /-/scrapes.
+const maxListedScrapes = 100
+
+// scrapesHandler lists the scrapes in flight as JSON, oldest first, e.g.
+// {"scrapes":[{"scrape_id":"...","target":"host:9100","elapsed_seconds":1.5}],"total":1}.
+func scrapesHandler(c *Coordinator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes, total := c.inFlight.list(time.Now(), maxListedScrapes)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Scrapes []scrapeStatus `json:"scrapes"`
+			Total   int            `json:"total"`
+		}{scrapes, total})
+	})
+}
+
+// registerLifecycleHandlers adds the endpoints that change the state of the
+// client to mux. They are unauthenticated, so only served with
+// --web.enable-lifecycle.
+func registerLifecycleHandlers(mux *http.ServeMux, c *Coordinator, reload func() error, quit chan<- struct{}) {
+	mux.Handle("/-/reload", reloadHandler(c.logger, reload))
+	mux.Handle("/-/quit", quitHandler(quit))
+	mux.Handle("/-/pause", pauseHandler(c, true))
+	mux.Handle("/-/resume", pauseHandler(c, false))
+}
+
+// quitHandler requests a graceful shutdown by closing quit on POST requests.
+func quitHandler(quit chan<- struct{}) http.Handler {
+	var once sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		once.Do(func() { close(quit) })
+		io.WriteString(w, "Requesting termination... Goodbye!\n")
+	})
+}
+
+// pauseHandler pauses or resumes scraping on POST requests.
+func pauseHandler(c *Coordinator, paused bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.setPaused(paused)
+		if paused {
+			level.Info(c.logger).Log("msg", "Scraping paused")
+			io.WriteString(w, "Scraping paused.\n")
+		} else {
+			level.Info(c.logger).Log("msg", "Scraping resumed")
+			io.WriteString(w, "Scraping resumed.\n")
+		}
+	})
+}
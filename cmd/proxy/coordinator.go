@@ -15,6 +15,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -30,6 +31,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var (
+	// errUnknownScrape is returned for results of scrapes we never handed
+	// out, as far as we remember.
+	errUnknownScrape = errors.New("unknown scrape id")
+	// errExpiredScrape is returned for results of scrapes nobody is waiting
+	// for anymore.
+	errExpiredScrape = errors.New("scrape already timed out or got its result")
+)
+
+// How long finished scrapes are remembered, so that late pushes aren't
+// mistaken for pushes from before a restart.
+const finishedScrapeRetention = time.Minute
+
 var (
 	registrationTimeout = kingpin.Flag("registration.timeout", "After how long a registration expires.").Default("5m").Duration()
 )
@@ -53,6 +67,8 @@ type Coordinator struct {
 	waiting map[string]chan *http.Request
 	// Responses from clients.
 	responses map[string]chan *http.Response
+	// Scrapes that timed out or got their result, and when.
+	finished map[string]time.Time
 	// Clients we know about and when they last contacted us.
 	known map[string]time.Time
 
@@ -64,6 +80,7 @@ func NewCoordinator(logger log.Logger) (*Coordinator, error) {
 	c := &Coordinator{
 		waiting:   map[string]chan *http.Request{},
 		responses: map[string]chan *http.Response{},
+		finished:  map[string]time.Time{},
 		known:     map[string]time.Time{},
 		logger:    logger,
 	}
@@ -100,11 +117,41 @@ func (c *Coordinator) getResponseChannel(id string) chan *http.Response {
 	return ch
 }
 
-// Remove a response channel. Idempotent.
+// lookupResponseChannel returns the response channel of a scrape that is
+// waiting for its result, errExpiredScrape if it finished recently and
+// errUnknownScrape otherwise.
+func (c *Coordinator) lookupResponseChannel(id string) (chan *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.responses[id]; ok {
+		return ch, nil
+	}
+	if _, ok := c.finished[id]; ok {
+		return nil, errExpiredScrape
+	}
+	return nil, errUnknownScrape
+}
+
+// Remove a response channel, remembering that the scrape finished.
+// Idempotent.
 func (c *Coordinator) removeResponseChannel(id string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.responses, id)
+	if _, ok := c.responses[id]; ok {
+		delete(c.responses, id)
+		c.finished[id] = time.Now()
+	}
+}
+
+// forgetFinished forgets the scrapes that finished before limit.
+func (c *Coordinator) forgetFinished(limit time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, t := range c.finished {
+		if t.Before(limit) {
+			delete(c.finished, id)
+		}
+	}
 }
 
 // DoScrape requests a scrape.
@@ -115,15 +162,16 @@ func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Resp
 	}
 	level.Info(c.logger).Log("msg", "DoScrape", "scrape_id", id, "url", r.URL.String())
 	r.Header.Add("Id", id)
+	// Wait for the result before handing out the scrape, so that it's known
+	// when the client pushes.
+	respCh := c.getResponseChannel(id)
+	defer c.removeResponseChannel(id)
 	select {
 	case <-ctx.Done():
 		return nil, fmt.Errorf("Timeout reached for %q: %s", r.URL.String(), ctx.Err())
 	case c.getRequestChannel(r.URL.Hostname()) <- r:
 	}
 
-	respCh := c.getResponseChannel(id)
-	defer c.removeResponseChannel(id)
-
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -172,8 +220,12 @@ func (c *Coordinator) ScrapeResult(r *http.Response) error {
 	// Don't expose internal headers.
 	r.Header.Del("Id")
 	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
+	ch, err := c.lookupResponseChannel(id)
+	if err != nil {
+		return err
+	}
 	select {
-	case c.getResponseChannel(id) <- r:
+	case ch <- r:
 		return nil
 	case <-ctx.Done():
 		c.removeResponseChannel(id)
@@ -204,9 +256,10 @@ func (c *Coordinator) KnownClients() []string {
 	return known
 }
 
-// Garbagee collect old clients.
+// Garbagee collect old clients and finished scrapes.
 func (c *Coordinator) gc() {
 	for range time.Tick(1 * time.Minute) {
+		c.forgetFinished(time.Now().Add(-finishedScrapeRetention))
 		func() {
 			c.mu.Lock()
 			defer c.mu.Unlock()
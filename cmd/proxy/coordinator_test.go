@@ -0,0 +1,119 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func newTestCoordinator(t *testing.T) *Coordinator {
+	max, def := *maxScrapeTimeout, *defaultScrapeTimeout
+	t.Cleanup(func() { *maxScrapeTimeout, *defaultScrapeTimeout = max, def })
+	*maxScrapeTimeout, *defaultScrapeTimeout = time.Minute, 10*time.Second
+	return &Coordinator{
+		waiting:   map[string]chan *http.Request{},
+		responses: map[string]chan *http.Response{},
+		finished:  map[string]time.Time{},
+		known:     map[string]time.Time{},
+		logger:    log.NewNopLogger(),
+	}
+}
+
+func scrapeResult(id string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Id": []string{id}}}
+}
+
+func TestScrapeResultUnknownScrape(t *testing.T) {
+	c := newTestCoordinator(t)
+	if err := c.ScrapeResult(scrapeResult("never-handed-out")); !errors.Is(err, errUnknownScrape) {
+		t.Errorf("Expected errUnknownScrape, got %v", err)
+	}
+}
+
+func TestScrapeResultTimedOutScrape(t *testing.T) {
+	c := newTestCoordinator(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "http://client:9100/metrics", nil)
+	// Nobody polls, so the scrape times out.
+	if _, err := c.DoScrape(ctx, req); err == nil {
+		t.Fatal("Expected the scrape to time out")
+	}
+	if err := c.ScrapeResult(scrapeResult(req.Header.Get("Id"))); !errors.Is(err, errExpiredScrape) {
+		t.Errorf("Expected errExpiredScrape for a late push, got %v", err)
+	}
+
+	c.forgetFinished(time.Now().Add(time.Second))
+	if err := c.ScrapeResult(scrapeResult(req.Header.Get("Id"))); !errors.Is(err, errUnknownScrape) {
+		t.Errorf("Expected errUnknownScrape once the scrape is forgotten, got %v", err)
+	}
+}
+
+func TestScrapeResultDuplicatePush(t *testing.T) {
+	c := newTestCoordinator(t)
+	go func() {
+		req, err := c.WaitForScrapeInstruction("client")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := c.ScrapeResult(scrapeResult(req.Header.Get("Id"))); err != nil {
+			t.Error(err)
+		}
+	}()
+	req := httptest.NewRequest("GET", "http://client:9100/metrics", nil)
+	if _, err := c.DoScrape(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ScrapeResult(scrapeResult(req.Header.Get("Id"))); !errors.Is(err, errExpiredScrape) {
+		t.Errorf("Expected errExpiredScrape for a second push, got %v", err)
+	}
+}
+
+func TestHandlePushErrors(t *testing.T) {
+	c := newTestCoordinator(t)
+	c.finished["timed-out"] = time.Now()
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+
+	for _, tc := range []struct {
+		id        string
+		code      int
+		errorType string
+	}{
+		{"never-handed-out", http.StatusNotFound, util.UnknownScrapeError},
+		{"timed-out", http.StatusGone, util.ExpiredScrapeError},
+	} {
+		buf := &bytes.Buffer{}
+		if err := scrapeResult(tc.id).Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.handlePush(w, httptest.NewRequest("POST", "/push", buf))
+		if w.Code != tc.code {
+			t.Errorf("Push of %s: expected status %d, got %d", tc.id, tc.code, w.Code)
+		}
+		if got := w.Header().Get(util.ErrorHeader); got != tc.errorType {
+			t.Errorf("Push of %s: expected error type %q, got %q", tc.id, tc.errorType, got)
+		}
+	}
+}
@@ -17,13 +17,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
@@ -45,8 +48,16 @@ var (
 	listenAddress        = kingpin.Flag("web.listen-address", "Address to listen on for proxy and client requests.").Default(":8080").String()
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+	registrationVerifyCA = kingpin.Flag("registration.verify-ca", "<file> CA certificates to verify signed registrations of clients against, see --proxy.sign-registration of the client. Polls without a valid signature for the FQDN they register are rejected with 403.").String()
 )
 
+// maxRegistrationSkew is how far the time of signed registrations may be
+// off.
+const maxRegistrationSkew = 5 * time.Minute
+
+// capabilities lists the optional protocol features advertised to clients.
+var capabilities = util.Capabilities{util.PushGzipCapability: true}
+
 var (
 	httpAPICounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -90,6 +101,9 @@ type httpHandler struct {
 	coordinator *Coordinator
 	mux         http.Handler
 	proxy       http.Handler
+	// CA certificates to verify registrations against, nil to accept
+	// unsigned ones.
+	registrationRoots *x509.CertPool
 }
 
 func newHTTPHandler(logger log.Logger, coordinator *Coordinator, mux *http.ServeMux) *httpHandler {
@@ -136,6 +150,18 @@ func (h *httpHandler) handlePush(w http.ResponseWriter, r *http.Request) {
 	scrapeId := scrapeResult.Header.Get("Id")
 	level.Info(h.logger).Log("msg", "Got /push", "scrape_id", scrapeId)
 	err = h.coordinator.ScrapeResult(scrapeResult)
+	if errors.Is(err, errUnknownScrape) {
+		level.Warn(h.logger).Log("msg", "Got push for unknown scrape", "scrape_id", scrapeId)
+		w.Header().Set(util.ErrorHeader, util.UnknownScrapeError)
+		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errExpiredScrape) {
+		level.Info(h.logger).Log("msg", "Got push for expired scrape", "scrape_id", scrapeId)
+		w.Header().Set(util.ErrorHeader, util.ExpiredScrapeError)
+		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), http.StatusGone)
+		return
+	}
 	if err != nil {
 		level.Error(h.logger).Log("msg", "Error pushing:", "err", err, "scrape_id", scrapeId)
 		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
@@ -144,13 +170,24 @@ func (h *httpHandler) handlePush(w http.ResponseWriter, r *http.Request) {
 
 // handlePoll handles clients registering and asking for scrapes.
 func (h *httpHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
-	fqdn, _ := ioutil.ReadAll(r.Body)
-	request, err := h.coordinator.WaitForScrapeInstruction(strings.TrimSpace(string(fqdn)))
+	body, _ := ioutil.ReadAll(r.Body)
+	fqdn := strings.TrimSpace(string(body))
+	if h.registrationRoots != nil {
+		if err := util.VerifyRegistration(r.Header, fqdn, h.registrationRoots, time.Now(), maxRegistrationSkew); err != nil {
+			level.Warn(h.logger).Log("msg", "Rejected registration", "fqdn", fqdn, "err", err)
+			http.Error(w, fmt.Sprintf("Invalid registration: %s", err), http.StatusForbidden)
+			return
+		}
+	}
+	request, err := h.coordinator.WaitForScrapeInstruction(fqdn)
 	if err != nil {
 		level.Info(h.logger).Log("msg", "Error WaitForScrapeInstruction:", "err", err)
 		http.Error(w, fmt.Sprintf("Error WaitForScrapeInstruction: %s", err.Error()), 408)
 		return
 	}
+	if len(capabilities) > 0 {
+		w.Header().Set(util.CapabilitiesHeader, capabilities.String())
+	}
 	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
 	request.WriteProxy(w) // Send full request as the body of the response.
 	level.Info(h.logger).Log("msg", "Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
@@ -209,6 +246,18 @@ func main() {
 
 	mux := http.NewServeMux()
 	handler := newHTTPHandler(logger, coordinator, mux)
+	if *registrationVerifyCA != "" {
+		pem, err := ioutil.ReadFile(*registrationVerifyCA)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to read --registration.verify-ca", "err", err)
+			os.Exit(1)
+		}
+		handler.registrationRoots = x509.NewCertPool()
+		if !handler.registrationRoots.AppendCertsFromPEM(pem) {
+			level.Error(logger).Log("msg", "No certificates found in --registration.verify-ca", "file", *registrationVerifyCA)
+			os.Exit(1)
+		}
+	}
 
 	level.Info(logger).Log("msg", "Listening", "address", *listenAddress)
 	if err := http.ListenAndServe(*listenAddress, handler); err != nil {
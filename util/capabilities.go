@@ -0,0 +1,61 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CapabilitiesHeader is set by the proxy on poll responses to advertise the
+// optional protocol features it supports.
+const CapabilitiesHeader = "X-PushProx-Capabilities"
+
+// PushGzipCapability is advertised by proxies that pass gzip compressed
+// pushes on to Prometheus unchanged.
+const PushGzipCapability = "push-gzip"
+
+// Capabilities is a set of optional protocol features.
+type Capabilities map[string]bool
+
+// ParseCapabilities returns the capabilities advertised in h. Proxies that
+// don't advertise anything yield an empty set.
+func ParseCapabilities(h http.Header) Capabilities {
+	c := Capabilities{}
+	for _, v := range h.Values(CapabilitiesHeader) {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				c[name] = true
+			}
+		}
+	}
+	return c
+}
+
+// Has reports whether the named capability is in the set.
+func (c Capabilities) Has(name string) bool {
+	return c[name]
+}
+
+// String returns the sorted, comma separated list of capabilities, as used
+// in the CapabilitiesHeader.
+func (c Capabilities) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
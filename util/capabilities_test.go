@@ -0,0 +1,38 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	// Older proxies don't advertise anything.
+	caps := ParseCapabilities(http.Header{})
+	if len(caps) != 0 {
+		t.Errorf("Expected no capabilities, got %q", caps)
+	}
+
+	header := http.Header{}
+	header.Add(CapabilitiesHeader, "gzip, HTTP2")
+	header.Add(CapabilitiesHeader, ",foo,")
+	caps = ParseCapabilities(header)
+	if caps.String() != "foo,gzip,http2" {
+		t.Errorf("Expected foo,gzip,http2, got %q", caps)
+	}
+	if !caps.Has("gzip") || caps.Has("bar") {
+		t.Errorf("Unexpected capabilities %q", caps)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+// ErrorHeader is set by the proxy on error responses whose cause the client
+// can act on.
+const ErrorHeader = "X-PushProx-Error"
+
+// UnknownScrapeError is the ErrorHeader value of 404 responses to pushes of
+// scrapes the proxy doesn't know, e.g. because it restarted since handing
+// out the scrape.
+const UnknownScrapeError = "unknown-scrape"
+
+// ExpiredScrapeError is the ErrorHeader value of 410 responses to pushes of
+// scrapes the proxy is no longer waiting for, because they timed out or
+// already got their result.
+const ExpiredScrapeError = "expired-scrape"
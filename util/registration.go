@@ -0,0 +1,136 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Headers of signed poll registrations.
+const (
+	RegistrationCertificateHeader = "X-PushProx-Registration-Certificate"
+	RegistrationTimestampHeader   = "X-PushProx-Registration-Timestamp"
+	RegistrationSignatureHeader   = "X-PushProx-Registration-Signature"
+)
+
+// registrationMessage is what gets signed for a registration of fqdn.
+func registrationMessage(fqdn, timestamp string) []byte {
+	return []byte(fqdn + "\n" + timestamp)
+}
+
+// SignRegistration sets the headers proving to the proxy that the client
+// registering fqdn at now holds the key of cert: the certificate itself,
+// the time and a signature of both the FQDN and the time with the key.
+func SignRegistration(h http.Header, cert *tls.Certificate, fqdn string, now time.Time) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate to sign the registration with")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("the certificate's private key can't sign")
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	message := registrationMessage(fqdn, timestamp)
+
+	var (
+		signature []byte
+		err       error
+	)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return errors.Wrap(err, "signing registration")
+	}
+	h.Set(RegistrationCertificateHeader, base64.StdEncoding.EncodeToString(cert.Certificate[0]))
+	h.Set(RegistrationTimestampHeader, timestamp)
+	h.Set(RegistrationSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// VerifyRegistration checks the headers set by SignRegistration for a
+// registration of fqdn: the certificate must be a client certificate issued
+// by roots and valid for fqdn, the time within maxSkew of now and the
+// signature made with the certificate's key.
+func VerifyRegistration(h http.Header, fqdn string, roots *x509.CertPool, now time.Time, maxSkew time.Duration) error {
+	der, err := base64.StdEncoding.DecodeString(h.Get(RegistrationCertificateHeader))
+	if err != nil || len(der) == 0 {
+		return errors.New("missing or invalid registration certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return errors.Wrap(err, "parsing registration certificate")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return errors.Wrap(err, "verifying registration certificate")
+	}
+	if err := cert.VerifyHostname(fqdn); err != nil {
+		return errors.Wrap(err, "registration certificate isn't valid for the FQDN")
+	}
+
+	timestamp := h.Get(RegistrationTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid registration timestamp")
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("registration timestamp is %s off", skew)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(h.Get(RegistrationSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing or invalid registration signature")
+	}
+	message := registrationMessage(fqdn, timestamp)
+	digest := sha256.Sum256(message)
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			err = errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			err = errors.New("invalid signature")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return errors.Wrap(err, "verifying registration signature")
+	}
+	return nil
+}
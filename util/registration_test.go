@@ -0,0 +1,128 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestCA returns a CA certificate and a function issuing client
+// certificates for fqdn from it.
+func newTestCA(t *testing.T) (*x509.CertPool, func(fqdn string, key crypto.Signer) *tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pushprox-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	return roots, func(fqdn string, key crypto.Signer) *tls.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: fqdn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			DNSNames:     []string{fqdn},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+}
+
+func TestSignRegistration(t *testing.T) {
+	roots, issue := newTestCA(t)
+	otherRoots, issueOther := newTestCA(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey, "ed25519": edKey} {
+		h := http.Header{}
+		if err := SignRegistration(h, issue("client.example.com", key), "client.example.com", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyRegistration(h, "client.example.com", roots, now, time.Minute); err != nil {
+			t.Errorf("Expected %s registration to be valid, got %v", name, err)
+		}
+	}
+
+	sign := func(cert *tls.Certificate, fqdn string, at time.Time) http.Header {
+		h := http.Header{}
+		if err := SignRegistration(h, cert, fqdn, at); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	tampered := sign(issue("client.example.com", ecKey), "client.example.com", now)
+	tampered.Set(RegistrationTimestampHeader, tampered.Get(RegistrationTimestampHeader)+"0")
+	for name, h := range map[string]http.Header{
+		"unsigned":              {},
+		"other host":            sign(issue("other.example.com", ecKey), "other.example.com", now),
+		"certificate for other": sign(issue("other.example.com", ecKey), "client.example.com", now),
+		"stale":                 sign(issue("client.example.com", ecKey), "client.example.com", now.Add(-time.Hour)),
+		"other CA":              sign(issueOther("client.example.com", ecKey), "client.example.com", now),
+		"tampered":              tampered,
+	} {
+		if err := VerifyRegistration(h, "client.example.com", roots, now, time.Minute); err == nil {
+			t.Errorf("Expected %s registration to be rejected", name)
+		}
+	}
+	// The CA decides.
+	if err := VerifyRegistration(sign(issueOther("client.example.com", ecKey), "client.example.com", now), "client.example.com", otherRoots, now, time.Minute); err != nil {
+		t.Errorf("Expected registration to be valid for its own CA, got %v", err)
+	}
+}